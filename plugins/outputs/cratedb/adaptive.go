@@ -0,0 +1,117 @@
+package cratedb
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// concurrencyLimiter adjusts the number of concurrent writes between a
+// minimum and the capacity of slots, the writeSlots of the plugin, if
+// AdaptiveConcurrency is set. It lowers the limit by parking tokens in slots
+// that no write can take, and raises it by removing parked tokens again.
+//
+// The limit is lowered by one whenever writes waited for a connection of the
+// pool since the last adjustment, i.e. the pool is the bottleneck, and raised
+// by one if writes only waited for a slot, i.e. the limit is.
+type concurrencyLimiter struct {
+	slots  chan struct{}
+	min    int
+	parked int
+	// limit is the current limit.
+	limit selfstat.Stat
+
+	// slotWaits is the number of writes that found no free slot since the
+	// last adjustment.
+	slotWaits int64
+	// waitCount is sql.DBStats.WaitCount at the last adjustment.
+	waitCount int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newConcurrencyLimiter returns a concurrencyLimiter starting at min
+// concurrent writes.
+func newConcurrencyLimiter(slots chan struct{}, min int, limit selfstat.Stat) *concurrencyLimiter {
+	l := &concurrencyLimiter{slots: slots, min: min, limit: limit}
+	for l.parked < cap(slots)-min {
+		slots <- struct{}{}
+		l.parked++
+	}
+	l.limit.Set(int64(min))
+	return l
+}
+
+// waited records that a write found no free slot.
+func (l *concurrencyLimiter) waited() {
+	atomic.AddInt64(&l.slotWaits, 1)
+}
+
+// adjust changes the limit by one given the current statistics of the pool.
+func (l *concurrencyLimiter) adjust(stats sql.DBStats) {
+	poolWaits := stats.WaitCount - l.waitCount
+	if poolWaits < 0 {
+		// The pool was replaced by a reconnect.
+		poolWaits = stats.WaitCount
+	}
+	l.waitCount = stats.WaitCount
+	slotWaits := atomic.SwapInt64(&l.slotWaits, 0)
+
+	switch {
+	case poolWaits > 0 && l.parked < cap(l.slots)-l.min:
+		// If all slots are taken, the limit is lowered once a write
+		// finishes, at the next adjustment.
+		select {
+		case l.slots <- struct{}{}:
+			l.parked++
+			log.Printf("D! CrateDB: %d writes waited %s for a connection, lowered concurrent writes to %d",
+				poolWaits, stats.WaitDuration, cap(l.slots)-l.parked)
+		default:
+		}
+	case poolWaits == 0 && slotWaits > 0 && l.parked > 0:
+		// There are at least parked tokens in slots, as every write takes
+		// one and returns one.
+		<-l.slots
+		l.parked--
+		log.Printf("D! CrateDB: %d writes waited for a slot, raised concurrent writes to %d",
+			slotWaits, cap(l.slots)-l.parked)
+	}
+	l.limit.Set(int64(cap(l.slots) - l.parked))
+}
+
+// start adjusts the limit every interval given the statistics of the pool
+// returned by db, until stop is called.
+func (l *concurrencyLimiter) start(interval time.Duration, db func() *sql.DB) {
+	l.done = make(chan struct{})
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				if db := db(); db != nil {
+					l.adjust(db.Stats())
+				}
+			}
+		}
+	}()
+}
+
+// stop stops adjusting the limit, if start was called.
+func (l *concurrencyLimiter) stop() {
+	if l.done == nil {
+		return
+	}
+	close(l.done)
+	l.wg.Wait()
+	l.done = nil
+}
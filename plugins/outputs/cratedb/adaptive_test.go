@@ -0,0 +1,81 @@
+package cratedb
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/selfstat"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	slots := make(chan struct{}, 3)
+	l := newConcurrencyLimiter(slots, 1, selfstat.Register("cratedb", "concurrent_writes_limit", map[string]string{"table": "limiter"}))
+	require.Len(t, slots, 2)
+	require.Equal(t, int64(1), l.limit.Get())
+
+	// Nobody waited, so the limit stays.
+	l.adjust(sql.DBStats{})
+	require.Equal(t, int64(1), l.limit.Get())
+
+	// Writes waited for each other.
+	for i := 0; i < 3; i++ {
+		l.waited()
+		l.adjust(sql.DBStats{})
+	}
+	require.Equal(t, int64(3), l.limit.Get())
+	require.Len(t, slots, 0)
+
+	// Writes waited for connections, which takes precedence.
+	l.waited()
+	l.adjust(sql.DBStats{WaitCount: 2})
+	require.Equal(t, int64(2), l.limit.Get())
+	l.adjust(sql.DBStats{WaitCount: 2})
+	require.Equal(t, int64(2), l.limit.Get())
+
+	// With all slots taken, the limit is lowered at a later adjustment.
+	slots <- struct{}{}
+	slots <- struct{}{}
+	l.adjust(sql.DBStats{WaitCount: 3})
+	require.Equal(t, int64(2), l.limit.Get())
+	<-slots
+	// The wait count of a new pool starts at 0.
+	l.adjust(sql.DBStats{WaitCount: 1})
+	require.Equal(t, int64(1), l.limit.Get())
+	l.adjust(sql.DBStats{WaitCount: 2})
+	require.Equal(t, int64(1), l.limit.Get())
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:               "adaptive_table",
+		Timeout:             internal.Duration{Duration: 50 * time.Millisecond},
+		AdaptiveConcurrency: true,
+		MaxConcurrentWrites: 2,
+		MinConcurrentWrites: 1,
+		AdaptiveInterval:    internal.Duration{Duration: time.Hour},
+	}
+	require.EqualError(t, c.setup(), "adaptive_concurrency requires max_open_connections")
+	c.MaxOpenConnections = 2
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.Equal(t, int64(1), c.concurrencyLimit.Get())
+
+	// The only slot is taken, so the write waits and gives up.
+	c.writeSlots <- struct{}{}
+	require.EqualError(t, c.Write(testutil.MockMetrics()), "timeout waiting for one of 1 concurrent writes to finish")
+	c.concurrency.adjust(sql.DBStats{})
+	require.Equal(t, int64(2), c.concurrencyLimit.Get())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	<-c.writeSlots
+
+	c.MinConcurrentWrites = 3
+	require.Error(t, c.setup())
+	c.MinConcurrentWrites = 1
+	c.MaxConcurrentWrites = 0
+	require.Error(t, c.setup())
+}
@@ -0,0 +1,133 @@
+package cratedb
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// errAsyncClosed is returned by asyncWriter.add once the writer is closed.
+var errAsyncClosed = errors.New("async writer is closed")
+
+// asyncWriter writes batches queued by Write in the background when Async
+// is set.
+type asyncWriter struct {
+	// mu guards closed and keeps close from closing queue while add sends
+	// to it.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []telegraf.Metric
+	// closing is closed once close is called, which makes add stop waiting
+	// for a free slot, so close can take mu.
+	closing     chan struct{}
+	closingOnce sync.Once
+	// stop is closed if close gives up waiting for the queue to drain, which
+	// makes the workers drop the remaining batches.
+	stop chan struct{}
+	// drop makes add drop batches instead of waiting if the queue is full.
+	drop bool
+	// depth is the number of queued batches.
+	depth selfstat.Stat
+	// failed counts the batches that couldn't be written.
+	failed selfstat.Stat
+	// dropped is the number of batches dropped after stop was closed.
+	dropped int64
+	wg      sync.WaitGroup
+}
+
+// newAsyncWriter starts workers goroutines passing the queued batches to
+// write.
+func newAsyncWriter(size, workers int, drop bool, depth, failed selfstat.Stat, write func([]telegraf.Metric) error) *asyncWriter {
+	a := &asyncWriter{
+		queue:   make(chan []telegraf.Metric, size),
+		closing: make(chan struct{}),
+		stop:    make(chan struct{}),
+		drop:    drop,
+		depth:   depth,
+		failed:  failed,
+	}
+	for i := 0; i < workers; i++ {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for metrics := range a.queue {
+				a.depth.Incr(-1)
+				select {
+				case <-a.stop:
+					atomic.AddInt64(&a.dropped, 1)
+					continue
+				default:
+				}
+				if err := write(metrics); err != nil {
+					a.failed.Incr(1)
+					log.Printf("E! CrateDB: dropped batch of %d metrics: %s", len(metrics), err)
+				}
+			}
+		}()
+	}
+	return a
+}
+
+// add queues a batch. If the queue is full, it waits for a free slot, or
+// drops the batch if drop is set. It returns errAsyncClosed if the writer is
+// closed, also while waiting.
+func (a *asyncWriter) add(metrics []telegraf.Metric) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return errAsyncClosed
+	}
+
+	a.depth.Incr(1)
+	if !a.drop {
+		select {
+		case a.queue <- metrics:
+			return nil
+		case <-a.closing:
+			a.depth.Incr(-1)
+			return errAsyncClosed
+		}
+	}
+	select {
+	case a.queue <- metrics:
+	default:
+		a.depth.Incr(-1)
+		log.Printf("W! CrateDB: async queue is full, dropped batch of %d metrics", len(metrics))
+	}
+	return nil
+}
+
+// close stops accepting batches and waits up to timeout for the queued ones
+// to be written. If they weren't written in time, the remaining batches are
+// dropped and their number is returned once the workers finished the
+// batches they're writing. Either way, no worker runs once close returns.
+func (a *asyncWriter) close(timeout time.Duration) int64 {
+	a.closingOnce.Do(func() { close(a.closing) })
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return 0
+	}
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+	close(a.stop)
+	<-done
+	return atomic.LoadInt64(&a.dropped)
+}
@@ -0,0 +1,146 @@
+package cratedb
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAsync(t *testing.T) {
+	defer useFakeDriver()()
+
+	release := make(chan struct{})
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if strings.HasPrefix(query, "INSERT") {
+				<-release
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		URL:               fd.dsn(t),
+		Table:             "async_table",
+		Timeout:           internal.Duration{Duration: time.Second * 5},
+		Async:             true,
+		AsyncQueueSize:    1,
+		AsyncWorkers:      1,
+		AsyncFullPolicy:   "drop",
+		AsyncDrainTimeout: internal.Duration{Duration: time.Second * 5},
+	}
+	require.NoError(t, c.Connect())
+
+	// The first batch is taken by the worker, which hangs, the second one is
+	// queued and the third one is dropped.
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	for c.asyncQueueDepth.Get() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, int64(1), c.asyncQueueDepth.Get())
+
+	// Close drains the queue.
+	close(release)
+	require.NoError(t, c.Close())
+	require.Equal(t, int64(0), c.asyncQueueDepth.Get())
+	require.Len(t, fd.statements(), 2)
+
+	// Write fails once the writer is closed.
+	require.Equal(t, errAsyncClosed, c.Write(testutil.MockMetrics()))
+
+	c.AsyncFullPolicy = "wait"
+	require.Error(t, c.setup())
+}
+
+func TestWriteAsyncDrainTimeout(t *testing.T) {
+	defer useFakeDriver()()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if strings.HasPrefix(query, "INSERT") {
+				started <- struct{}{}
+				<-release
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		URL:               fd.dsn(t),
+		Table:             "async_drain_table",
+		Timeout:           internal.Duration{Duration: time.Second * 5},
+		Async:             true,
+		AsyncQueueSize:    2,
+		AsyncWorkers:      1,
+		AsyncFullPolicy:   "block",
+		AsyncDrainTimeout: internal.Duration{Duration: 10 * time.Millisecond},
+	}
+	require.NoError(t, c.Connect())
+	failed := c.asyncBatchesFailed.Get()
+
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	<-started
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+
+	// A Write waiting for a free slot fails once Close is called, and Close
+	// waits for the hanging batch before closing the DB, dropping the queued
+	// ones.
+	blocked := make(chan error)
+	go func() { blocked <- c.Write(testutil.MockMetrics()) }()
+	closed := make(chan error)
+	go func() { closed <- c.Close() }()
+	require.Equal(t, errAsyncClosed, <-blocked)
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the hanging batch was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-closed)
+	require.Len(t, fd.statements(), 1)
+	require.Equal(t, int64(2), c.asyncBatchesFailed.Get()-failed)
+	require.Equal(t, int64(0), c.asyncQueueDepth.Get())
+}
+
+func TestWriteAsyncConcurrentClose(t *testing.T) {
+	defer useFakeDriver()()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:               fd.dsn(t),
+		Table:             "async_close_table",
+		Timeout:           internal.Duration{Duration: time.Second * 5},
+		Async:             true,
+		AsyncQueueSize:    1,
+		AsyncWorkers:      2,
+		AsyncFullPolicy:   "block",
+		AsyncDrainTimeout: internal.Duration{Duration: time.Second * 5},
+	}
+	require.NoError(t, c.Connect())
+
+	// Writes racing with Close either succeed or fail, but never panic.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := c.Write(testutil.MockMetrics()); err != nil {
+					if err != errAsyncClosed {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	require.NoError(t, c.Close())
+	wg.Wait()
+}
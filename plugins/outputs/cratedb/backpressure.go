@@ -0,0 +1,49 @@
+package cratedb
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// backpressure detects sustained backpressure from CrateDB for the
+// BackpressureInterval option: it's reported once BackpressureWrites writes
+// in a row took longer than BackpressureRatio times the interval, and
+// cleared by the next write that doesn't.
+type backpressure struct {
+	mu sync.Mutex
+	// slow is the number of slow writes in a row.
+	slow   int
+	active bool
+}
+
+// observeWrite records that a write, including the wait for a write slot
+// and a connection of the pool, took d.
+func (c *CrateDB) observeWrite(d time.Duration) {
+	c.writeDuration.Set(d.Nanoseconds())
+	if c.BackpressureInterval.Duration <= 0 {
+		return
+	}
+	threshold := time.Duration(c.BackpressureRatio * float64(c.BackpressureInterval.Duration))
+
+	b := &c.backpressure
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d <= threshold {
+		b.slow = 0
+		if b.active {
+			b.active = false
+			c.backpressureActive.Set(0)
+			log.Printf("I! CrateDB: write to %s took %s, backpressure cleared", c.Table, d)
+		}
+		return
+	}
+	b.slow++
+	if b.slow >= c.BackpressureWrites && !b.active {
+		b.active = true
+		c.backpressureActive.Set(1)
+		log.Printf("W! CrateDB: the last %d writes to %s took longer than %s, the last one %s; "+
+			"CrateDB is not keeping up and metrics may be dropped once the buffer is full",
+			b.slow, c.Table, threshold, d)
+	}
+}
@@ -0,0 +1,44 @@
+package cratedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveWriteBackpressure(t *testing.T) {
+	c := &CrateDB{
+		Table:                "backpressure_table",
+		BackpressureInterval: internal.Duration{Duration: 10 * time.Second},
+		BackpressureRatio:    0.5,
+		BackpressureWrites:   2,
+	}
+	require.NoError(t, c.setup())
+
+	c.observeWrite(6 * time.Second)
+	require.Equal(t, int64(6*time.Second), c.writeDuration.Get())
+	require.Equal(t, int64(0), c.backpressureActive.Get())
+	// A fast write in between resets the count.
+	c.observeWrite(time.Second)
+	c.observeWrite(6 * time.Second)
+	require.Equal(t, int64(0), c.backpressureActive.Get())
+	c.observeWrite(6 * time.Second)
+	require.Equal(t, int64(1), c.backpressureActive.Get())
+	c.observeWrite(time.Second)
+	require.Equal(t, int64(0), c.backpressureActive.Get())
+
+	c.BackpressureRatio = 0
+	require.Error(t, c.setup())
+	c.BackpressureRatio = 1
+	c.BackpressureWrites = 0
+	require.Error(t, c.setup())
+
+	// Without an interval, only the duration is reported.
+	c = &CrateDB{Table: "backpressure_table_disabled"}
+	require.NoError(t, c.setup())
+	c.observeWrite(time.Hour)
+	c.observeWrite(time.Hour)
+	require.Equal(t, int64(0), c.backpressureActive.Get())
+}
@@ -0,0 +1,113 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// breakerLimitSQL reads the limit of the request circuit breaker, which
+	// CrateDB trips if building the rows of a statement needs more memory.
+	breakerLimitSQL = `SELECT settings['indices']['breaker']['request']['limit'] FROM sys.cluster`
+	// heapSQL reads the smallest heap of the nodes, which a breaker limit
+	// given in percent refers to.
+	heapSQL = `SELECT min(heap['max']) FROM sys.nodes`
+	// autoTuneShare is the share of the breaker limit a single statement
+	// may use, leaving room for concurrent writes and queries.
+	autoTuneShare = 10
+)
+
+// byteUnits are the units of byte sizes in CrateDB settings.
+var byteUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"tb", 1 << 40},
+	{"b", 1},
+}
+
+// autoTuneBatch derives the memory a statement may use from the request
+// circuit breaker of the cluster if AutoTuneBatch is set. If the settings
+// can't be read, the static MaxBatchMemory keeps being used.
+func (c *CrateDB) autoTuneBatch(ctx context.Context, db *sql.DB) {
+	if !c.AutoTuneBatch {
+		return
+	}
+	limit, err := requestBreakerLimit(ctx, db)
+	if err != nil {
+		log.Printf("W! CrateDB: auto_tune_batch: reading the circuit breaker limit failed, using max_batch_memory: %s", err)
+		atomic.StoreInt64(&c.tunedMemory, 0)
+		c.tunedBatchMemory.Set(0)
+		return
+	}
+	tuned := limit / autoTuneShare
+	atomic.StoreInt64(&c.tunedMemory, tuned)
+	c.tunedBatchMemory.Set(tuned)
+	log.Printf("I! CrateDB: auto_tune_batch: limiting statements to %d bytes, 1/%d of the circuit breaker limit of %d bytes", tuned, autoTuneShare, limit)
+}
+
+// maxBatchMemory returns the memory a statement may use, which is the
+// smaller one of MaxBatchMemory and the one derived by autoTuneBatch, or 0
+// if there's no limit.
+func (c *CrateDB) maxBatchMemory() int64 {
+	tuned := atomic.LoadInt64(&c.tunedMemory)
+	if tuned > 0 && (c.MaxBatchMemory <= 0 || tuned < c.MaxBatchMemory) {
+		return tuned
+	}
+	return c.MaxBatchMemory
+}
+
+// requestBreakerLimit returns the limit of the request circuit breaker in
+// bytes.
+func requestBreakerLimit(ctx context.Context, db *sql.DB) (int64, error) {
+	var setting sql.NullString
+	if err := db.QueryRowContext(ctx, breakerLimitSQL).Scan(&setting); err != nil {
+		return 0, err
+	} else if !setting.Valid {
+		return 0, fmt.Errorf("setting is not set")
+	}
+	var heap int64
+	if strings.HasSuffix(setting.String, "%") {
+		var max sql.NullInt64
+		if err := db.QueryRowContext(ctx, heapSQL).Scan(&max); err != nil {
+			return 0, err
+		} else if !max.Valid {
+			return 0, fmt.Errorf("no heap size reported")
+		}
+		heap = max.Int64
+	}
+	return parseByteSize(setting.String, heap)
+}
+
+// parseByteSize parses a byte size setting of CrateDB, e.g. "512mb", or a
+// percentage of heap, e.g. "60%".
+func parseByteSize(s string, heap int64) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	factor, percent := int64(1), false
+	if strings.HasSuffix(v, "%") {
+		v, percent = strings.TrimSuffix(v, "%"), true
+	} else {
+		for _, unit := range byteUnits {
+			if strings.HasSuffix(v, unit.suffix) {
+				v, factor = strings.TrimSuffix(v, unit.suffix), unit.factor
+				break
+			}
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	if percent {
+		return int64(n / 100 * float64(heap)), nil
+	}
+	return int64(n * float64(factor)), nil
+}
@@ -0,0 +1,80 @@
+package cratedb
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseByteSize(t *testing.T) {
+	for _, test := range []struct {
+		Setting string
+		Want    int64
+	}{
+		{"1024", 1024},
+		{"512b", 512},
+		{"64kb", 64 << 10},
+		{"512mb", 512 << 20},
+		{"1.5GB", 3 << 29},
+		{"60%", 600},
+		{"12.5%", 125},
+	} {
+		got, err := parseByteSize(test.Setting, 1000)
+		require.NoError(t, err, test.Setting)
+		require.Equal(t, test.Want, got, test.Setting)
+	}
+	for _, setting := range []string{"", "mb", "-1mb", "0", "much"} {
+		_, err := parseByteSize(setting, 1000)
+		require.Error(t, err, setting)
+	}
+}
+
+func TestConnectAutoTuneBatch(t *testing.T) {
+	defer useFakeDriver()()
+
+	limit := driver.Value("60%")
+	fd := &fakeDriver{
+		query: func(query string) ([]string, [][]driver.Value, error) {
+			switch query {
+			case breakerLimitSQL:
+				return []string{"limit"}, [][]driver.Value{{limit}}, nil
+			case heapSQL:
+				return []string{"heap"}, [][]driver.Value{{int64(1 << 30)}}, nil
+			case "SELECT 1":
+				return []string{"1"}, [][]driver.Value{{int64(1)}}, nil
+			}
+			t.Errorf("unexpected query: %s", query)
+			return nil, nil, nil
+		},
+	}
+	c := &CrateDB{
+		URL:           fd.dsn(t),
+		Table:         "auto_tune_table",
+		Timeout:       internal.Duration{Duration: time.Second * 5},
+		AutoTuneBatch: true,
+	}
+	require.NoError(t, c.Connect())
+	require.Equal(t, int64(644245094/autoTuneShare), c.maxBatchMemory())
+	// Another output writing the same table doesn't change the limit.
+	other := &CrateDB{Table: c.Table}
+	require.NoError(t, other.setup())
+	other.tunedBatchMemory.Set(1)
+	require.Equal(t, int64(644245094/autoTuneShare), c.maxBatchMemory())
+	require.NoError(t, c.Close())
+
+	// A lower static limit wins.
+	c.MaxBatchMemory = 1 << 20
+	require.NoError(t, c.Connect())
+	require.Equal(t, int64(1<<20), c.maxBatchMemory())
+	require.NoError(t, c.Close())
+
+	// The static limit is used if the setting can't be read.
+	limit = nil
+	require.NoError(t, c.Connect())
+	require.Equal(t, int64(0), c.tunedBatchMemory.Get())
+	require.Equal(t, int64(1<<20), c.maxBatchMemory())
+	require.NoError(t, c.Close())
+}
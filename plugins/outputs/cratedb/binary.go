@@ -0,0 +1,59 @@
+package cratedb
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/influxdata/telegraf"
+)
+
+// binaryEncodings encode the bytes of BinaryFields by BinaryEncoding. "utf8"
+// keeps them as they are, so invalid UTF-8 is only replaced if SanitizeUTF8
+// is set.
+var binaryEncodings = map[string]func([]byte) string{
+	"utf8":   func(b []byte) string { return string(b) },
+	"hex":    hex.EncodeToString,
+	"base64": base64.StdEncoding.EncodeToString,
+}
+
+// binaryColumns returns the STRING columns of BinaryFields.
+func (c *CrateDB) binaryColumns() ([]column, error) {
+	encoding := c.BinaryEncoding
+	if encoding == "" {
+		encoding = "base64"
+	}
+	encode, ok := binaryEncodings[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unknown binary_encoding: %q", c.BinaryEncoding)
+	}
+	cols := make([]column, 0, len(c.BinaryFields))
+	for _, field := range c.BinaryFields {
+		cols = append(cols, binaryColumn(c.columnName(field), field, encode))
+	}
+	return cols, nil
+}
+
+// binaryColumn returns a STRING column holding the bytes of field, which is
+// a string or []byte, encoded with encode. The field is removed from the
+// "fields" object.
+func binaryColumn(name, field string, encode func([]byte) string) column {
+	return column{
+		Name: name,
+		Type: "STRING",
+		Value: func(m telegraf.Metric, tags map[string]string, fields map[string]interface{}) (interface{}, error) {
+			val, ok := fields[field]
+			if !ok {
+				return nil, nil
+			}
+			delete(fields, field)
+			switch t := val.(type) {
+			case string:
+				return encode([]byte(t)), nil
+			case []byte:
+				return encode(t), nil
+			}
+			return nil, fmt.Errorf("%s: field %q is not binary: %#v", m.Name(), field, val)
+		},
+	}
+}
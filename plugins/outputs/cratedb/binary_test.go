@@ -0,0 +1,59 @@
+package cratedb
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryFieldsRoundTrip(t *testing.T) {
+	payload := make([]byte, 256)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("packet", map[string]string{}, map[string]interface{}{
+		"payload": string(payload),
+		"size":    int64(len(payload)),
+	}, now)
+	require.NoError(t, err)
+	require.Equal(t, string(payload), m.Fields()["payload"])
+
+	literal := regexp.MustCompile(`, '([^']*)'\);$`)
+	for encoding, decode := range map[string]func(string) ([]byte, error){
+		"":       base64.StdEncoding.DecodeString,
+		"base64": base64.StdEncoding.DecodeString,
+		"hex":    hex.DecodeString,
+	} {
+		c := &CrateDB{
+			Table:           "my_table",
+			BinaryFields:    []string{"payload"},
+			BinaryEncoding:  encoding,
+			IndexOffColumns: []string{"payload"},
+		}
+		require.NoError(t, c.setup(), encoding)
+		require.Contains(t, c.createSQL(), "\n\t\"payload\" STRING INDEX OFF", encoding)
+		got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+		require.NoError(t, err, encoding)
+		require.Contains(t, got, `"fields", "payload")`, encoding)
+		require.Contains(t, got, `{"size" = 256}`, encoding)
+		match := literal.FindStringSubmatch(got)
+		require.NotNil(t, match, got)
+		decoded, err := decode(match[1])
+		require.NoError(t, err, encoding)
+		require.Equal(t, payload, decoded, encoding)
+	}
+
+	c := &CrateDB{Table: "my_table", BinaryFields: []string{"size"}}
+	require.NoError(t, c.setup())
+	_, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.Error(t, err)
+	c.BinaryEncoding = "base32"
+	require.Error(t, c.setup())
+}
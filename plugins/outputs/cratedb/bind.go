@@ -0,0 +1,144 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxPreparedStatements limits the number of statements kept prepared by
+// preparedStatements. The bound statements only differ in their columns, so
+// this is only reached if long_column_suffixes produces many combinations.
+const maxPreparedStatements = 100
+
+// statement is an INSERT statement built by insertStatement. If InsertStyle
+// is "unnest_bind", bound holds the same statement with one bound array
+// parameter per column, whose values are in args, and sql is used if CrateDB
+// doesn't support it, as well as for spooling. table is the table it writes
+// to.
+type statement struct {
+	table string
+	sql   string
+	bound string
+	args  []interface{}
+}
+
+// bindSource returns the part of a bound INSERT statement that provides the
+// rows and its arguments, given the names of the columns and the bind values
+// of each row, see escaper.bindValue.
+func (c *CrateDB) bindSource(columns []string, rows [][]interface{}) (string, []interface{}) {
+	types := make(map[string]string)
+	for _, col := range c.schema() {
+		types[col.Name] = castType(col.Type)
+	}
+	params := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for j, name := range columns {
+		typ, ok := types[name]
+		if !ok {
+			// A column promoted by LongColumnSuffixes.
+			typ = "LONG"
+		}
+		elems := make([]interface{}, len(rows))
+		for i, r := range rows {
+			elems[i] = r[j]
+		}
+		params[j] = fmt.Sprintf("$%d::ARRAY(%s)", j+1, typ)
+		args[j] = pq.GenericArray{A: elems}
+	}
+	return `(SELECT * FROM unnest(` + strings.Join(params, ", ") + `))`, args
+}
+
+// bindValue converts val into an element of a bound array parameter. Objects
+// are passed as JSON, which CrateDB casts to OBJECT, and timestamps are
+// formatted just like escape does.
+func (e *escaper) bindValue(val interface{}) (interface{}, error) {
+	switch t := val.(type) {
+	case string:
+		if e.utf8 != nil {
+			return e.utf8.sanitize(t), nil
+		}
+		return t, nil
+	case nil, int64, float64, bool:
+		return t, nil
+	case int:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case float32:
+		return float64(t), nil
+	case decimal, bitString:
+		return fmt.Sprint(t), nil
+	case double:
+		return float64(t), nil
+	case time.Time:
+		return e.formatTime(t), nil
+	case map[string]string, map[string]interface{}, []interface{}:
+		data, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	default:
+		return nil, fmt.Errorf("unexpected type: %T: %#v", t, t)
+	}
+}
+
+// preparedStatements caches the bound statements prepared on a connection
+// pool, so CrateDB parses each of them only once per connection.
+type preparedStatements struct {
+	mu    sync.Mutex
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+}
+
+// exec executes query with args on db, using a prepared statement.
+func (p *preparedStatements) exec(ctx context.Context, db *sql.DB, query string, args []interface{}) (sql.Result, error) {
+	stmt, err := p.prepare(ctx, db, query)
+	if err != nil {
+		return nil, err
+	} else if stmt == nil {
+		return db.ExecContext(ctx, query, args...)
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// prepare returns the prepared statement for query on db, preparing it if
+// needed. It returns nil if there are too many prepared statements already.
+// The statements of a previous pool are closed.
+func (p *preparedStatements) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.db != db {
+		for _, stmt := range p.stmts {
+			stmt.Close()
+		}
+		p.db = db
+		p.stmts = make(map[string]*sql.Stmt)
+	}
+	if stmt, ok := p.stmts[query]; ok {
+		return stmt, nil
+	} else if len(p.stmts) >= maxPreparedStatements {
+		return nil, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	p.stmts[query] = stmt
+	return stmt, nil
+}
+
+// len returns the number of prepared statements.
+func (p *preparedStatements) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stmts)
+}
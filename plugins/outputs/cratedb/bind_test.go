@@ -0,0 +1,104 @@
+package cratedb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_insertStatementUnnestBind(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage": 0.5, "count": int64(3)}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": `it's "b"`}, map[string]interface{}{"status": "ok"}, now.Add(time.Second))
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:            "my_table",
+		InsertStyle:      "unnest_bind",
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 10,
+		DecimalScale:     2,
+	}
+	require.NoError(t, c.setup())
+	rows, err := c.newRows([]telegraf.Metric{m1, m2})
+	require.NoError(t, err)
+	st, n, err := c.insertStatement(rows, time.UTC, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.True(t, strings.HasPrefix(st.sql, "INSERT INTO my_table (\"hash_id\", \"timestamp\", \"name\", \"tags\", \"fields\", \"price\")\n(SELECT * FROM unnest(["))
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price")
+(SELECT * FROM unnest($1::ARRAY(LONG), $2::ARRAY(TIMESTAMP), $3::ARRAY(STRING), $4::ARRAY(OBJECT(DYNAMIC)), $5::ARRAY(OBJECT(DYNAMIC)), $6::ARRAY(NUMERIC(10, 2))));
+`), st.bound)
+
+	var args []string
+	for _, arg := range st.args {
+		v, err := arg.(driver.Valuer).Value()
+		require.NoError(t, err)
+		args = append(args, v.(string))
+	}
+	require.Equal(t, []string{
+		fmt.Sprintf("{%d,%d}", int64(m1.HashID()), int64(m2.HashID())),
+		`{"2009-11-10T23:00:00+0000","2009-11-10T23:00:01+0000"}`,
+		`{"cpu","cpu"}`,
+		`{"{\"host\":\"a\"}","{\"host\":\"it's \\\"b\\\"\"}"}`,
+		`{"{\"count\":3,\"usage\":0.5}","{\"status\":\"ok\"}"}`,
+		`{NULL,NULL}`,
+	}, args)
+
+	c.TagsStorage = "array"
+	require.Error(t, c.setup())
+}
+
+func TestWriteUnnestBind(t *testing.T) {
+	now := time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+
+	var unsupported bool
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if unsupported && strings.Contains(query, "$1") {
+				return &pq.Error{Message: "SQLParseException: unsupported"}
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		Table:       "my_table",
+		Timeout:     internal.Duration{Duration: time.Second * 5},
+		InsertStyle: "unnest_bind",
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	// The statement is prepared once and executed with new arguments.
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	stmts := fd.statements()
+	require.Len(t, stmts, 2)
+	require.Equal(t, stmts[0], stmts[1])
+	require.Contains(t, stmts[0], "unnest($1::ARRAY(LONG), ")
+	require.Len(t, fd.arguments()[0], 5)
+	require.Equal(t, 1, c.prepared.len())
+
+	// If CrateDB rejects the bound statement, the literal one is used for
+	// the rest of the session.
+	unsupported = true
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	stmts = fd.statements()[2:]
+	require.Len(t, stmts, 3)
+	require.Contains(t, stmts[0], "$1")
+	require.Contains(t, stmts[1], "(SELECT * FROM unnest([")
+	require.Equal(t, stmts[1], stmts[2])
+}
@@ -0,0 +1,85 @@
+package cratedb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// maxBitWidth is the largest width of BitColumns, since the values are
+// integers.
+const maxBitWidth = 64
+
+// bitString holds the digits of a BIT(n) value, which escapeValue emits as a
+// bit string literal, e.g. B'0101'.
+type bitString string
+
+// bitColumns returns the BIT(n) columns of BitColumns, sorted by field.
+func (c *CrateDB) bitColumns() ([]column, error) {
+	switch c.BitOverflow {
+	case "", "error", "truncate":
+	default:
+		return nil, fmt.Errorf("unknown bit_overflow: %q", c.BitOverflow)
+	}
+	fields := make([]string, 0, len(c.BitColumns))
+	for field := range c.BitColumns {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	cols := make([]column, 0, len(fields))
+	for _, field := range fields {
+		width := c.BitColumns[field]
+		if width < 1 || width > maxBitWidth {
+			return nil, fmt.Errorf("bit_columns: width of field %q must be between 1 and %d: %d", field, maxBitWidth, width)
+		}
+		cols = append(cols, c.bitColumn(field, width))
+	}
+	return cols, nil
+}
+
+// bitColumn returns a BIT(width) column holding the integer field as width
+// bits, the most significant first. The field is removed from the "fields"
+// object.
+func (c *CrateDB) bitColumn(field string, width int) column {
+	return column{
+		Name: c.columnName(field),
+		Type: fmt.Sprintf("BIT(%d)", width),
+		Value: func(m telegraf.Metric, tags map[string]string, fields map[string]interface{}) (interface{}, error) {
+			val, ok := fields[field]
+			if !ok {
+				return nil, nil
+			}
+			delete(fields, field)
+			var bits uint64
+			switch t := val.(type) {
+			case int64:
+				// Negative values are stored as their two's complement, so
+				// they only fit into BIT(64).
+				bits = uint64(t)
+			case uint64:
+				bits = t
+			default:
+				return nil, fmt.Errorf("%s: field %q can't be stored as BIT(%d): %#v", m.Name(), field, width, val)
+			}
+			s, fits := toBits(bits, width)
+			if !fits && c.BitOverflow != "truncate" {
+				return nil, fmt.Errorf("%s: field %q doesn't fit into BIT(%d): %v", m.Name(), field, width, val)
+			}
+			return s, nil
+		},
+	}
+}
+
+// toBits returns the lowest width bits of v, the most significant first, and
+// whether v fits into them.
+func toBits(v uint64, width int) (bitString, bool) {
+	s := strconv.FormatUint(v, 2)
+	if len(s) > width {
+		return bitString(s[len(s)-width:]), false
+	}
+	return bitString(strings.Repeat("0", width-len(s)) + s), true
+}
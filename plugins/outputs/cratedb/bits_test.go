@@ -0,0 +1,97 @@
+package cratedb
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_toBits(t *testing.T) {
+	for _, test := range []struct {
+		Value uint64
+		Width int
+		Want  bitString
+		Fits  bool
+	}{
+		{0, 1, "0", true},
+		{1, 1, "1", true},
+		{2, 1, "0", false},
+		{5, 4, "0101", true},
+		{15, 4, "1111", true},
+		{16, 4, "0000", false},
+		{0x1ff, 8, "11111111", false},
+		{math.MaxUint64, 64, bitString(strings.Repeat("1", 64)), true},
+		{1 << 63, 64, bitString("1" + strings.Repeat("0", 63)), true},
+	} {
+		got, fits := toBits(test.Value, test.Width)
+		require.Equal(t, test.Want, got, "%d/%d", test.Value, test.Width)
+		require.Equal(t, test.Fits, fits, "%d/%d", test.Value, test.Width)
+	}
+}
+
+func Test_insertSQLBitColumns(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(fields map[string]interface{}) telegraf.Metric {
+		m, err := metric.New("device", map[string]string{}, fields, now)
+		require.NoError(t, err)
+		return m
+	}
+
+	c := &CrateDB{Table: "my_table", BitColumns: map[string]int{"flags": 4, "mask": 64}}
+	require.NoError(t, c.setup())
+	require.Contains(t, c.createSQL(), `"flags" BIT(4),`)
+	require.Contains(t, c.createSQL(), `"mask" BIT(64),`)
+
+	m := newMetric(map[string]interface{}{"flags": int64(5), "mask": int64(-1), "temp": 0.5})
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "flags", "mask")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'device', {}, {"temp" = 0.5}, B'0101', B'`+strings.Repeat("1", 64)+`');
+`), got)
+
+	// A missing field is stored as NULL.
+	got, err = c.insertSQL([]telegraf.Metric{newMetric(map[string]interface{}{"temp": 0.5})}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"temp" = 0.5}, NULL, NULL);`)
+
+	for _, fields := range []map[string]interface{}{
+		{"flags": int64(16)},
+		{"flags": int64(-1)},
+		{"flags": 5.0},
+		{"flags": "0101"},
+	} {
+		_, err = c.insertSQL([]telegraf.Metric{newMetric(fields)}, time.UTC)
+		require.Error(t, err, "%v", fields)
+	}
+
+	c.BitOverflow = "truncate"
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{newMetric(map[string]interface{}{"flags": int64(0x1a)})}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `B'1010'`)
+	got, err = c.insertSQL([]telegraf.Metric{newMetric(map[string]interface{}{"flags": int64(-2)})}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `B'1110'`)
+
+	for _, test := range []struct {
+		Columns  map[string]int
+		Overflow string
+	}{
+		{map[string]int{"flags": 0}, ""},
+		{map[string]int{"flags": 65}, ""},
+		{map[string]int{"flags": 4}, "wrap"},
+		{map[string]int{"name": 4}, ""},
+	} {
+		c.BitColumns = test.Columns
+		c.BitOverflow = test.Overflow
+		require.Error(t, c.setup(), "%v", test)
+	}
+}
@@ -0,0 +1,35 @@
+package cratedb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"hash/fnv"
+	"strings"
+)
+
+// checksumType returns the type of the checksum column for algorithm.
+func checksumType(algorithm string) string {
+	if algorithm == "sha256" {
+		return "STRING INDEX OFF"
+	}
+	return "LONG INDEX OFF"
+}
+
+// checksum returns the value of the checksum column for a row with the given
+// escaped values, which is computed over the values joined by ", ", i.e. the
+// row as it's written in the VALUES list of the statement.
+func checksum(algorithm string, escaped []string) interface{} {
+	data := []byte(strings.Join(escaped, ", "))
+	switch algorithm {
+	case "crc32":
+		return int64(crc32.ChecksumIEEE(data))
+	case "sha256":
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	default:
+		h := fnv.New64a()
+		h.Write(data)
+		return int64(h.Sum64())
+	}
+}
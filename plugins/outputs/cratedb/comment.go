@@ -0,0 +1,33 @@
+package cratedb
+
+import (
+	"strings"
+	"unicode"
+)
+
+// commentDelimiters breaks up the delimiters of SQL comments, so the text of
+// a StatementComment can't end the comment it's wrapped in.
+var commentDelimiters = strings.NewReplacer("*/", "* /", "/*", "/ *")
+
+// statementComment returns the SQL comment prepended to statements for the
+// expanded StatementComment text, or an empty string if text is empty.
+// Control characters are replaced with spaces, so the comment stays on one
+// line of the job log.
+func statementComment(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	// Replacing a delimiter can create a new one with its neighbours, e.g.
+	// in "/*/".
+	for strings.Contains(text, "*/") || strings.Contains(text, "/*") {
+		text = commentDelimiters.Replace(text)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	return "/* " + text + " */ "
+}
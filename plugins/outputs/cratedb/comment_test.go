@@ -0,0 +1,56 @@
+package cratedb
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_statementComment(t *testing.T) {
+	for _, test := range []struct {
+		Text string
+		Want string
+	}{
+		{"telegraf host=web1", "/* telegraf host=web1 */ "},
+		{"", ""},
+		{" \n ", ""},
+		{"a */ DROP TABLE metrics; /* b", "/* a * / DROP TABLE metrics; / * b */ "},
+		{"/*/", "/* / * / */ "},
+		{"**//", "/* ** // */ "},
+		{"line\nbreak", "/* line break */ "},
+	} {
+		got := statementComment(test.Text)
+		require.Equal(t, test.Want, got, test.Text)
+		inner := strings.TrimSuffix(strings.TrimPrefix(got, "/* "), " */ ")
+		require.NotContains(t, inner, "*/", test.Text)
+		require.NotContains(t, inner, "/*", test.Text)
+	}
+}
+
+func TestWriteStatementComment(t *testing.T) {
+	defer func(h func() (string, error)) { hostname = h }(hostname)
+	hostname = func() (string, error) { return "collector", nil }
+	defer os.Unsetenv("CRATEDB_TEST_JOB")
+	os.Setenv("CRATEDB_TEST_JOB", "nightly")
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:            "my_table",
+		Timeout:          internal.Duration{Duration: time.Second * 5},
+		StatementComment: "telegraf host=%h job=${CRATEDB_TEST_JOB}",
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	stmts := fd.statements()
+	require.Len(t, stmts, 1)
+	require.True(t, strings.HasPrefix(stmts[0], "/* telegraf host=collector job=nightly */ INSERT INTO my_table "), stmts[0])
+
+	c.StatementComment = "%x"
+	require.Error(t, c.setup())
+}
@@ -0,0 +1,359 @@
+// +build integration
+
+package cratedb
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+// The integration tests only run if CRATE_INTEGRATION is set, e.g.:
+//
+//   CRATE_INTEGRATION=1 go test -tags integration ./plugins/outputs/cratedb/
+//
+// If CRATE_URL is set as well, the tests use the given CrateDB instance,
+// otherwise a CrateDB container (CRATE_IMAGE, default "crate") is started via
+// docker for the duration of the tests.
+
+// integrationURL is the connection string of the CrateDB instance used by the
+// integration tests.
+var integrationURL string
+
+func TestMain(m *testing.M) {
+	if os.Getenv("CRATE_INTEGRATION") == "" {
+		os.Exit(m.Run())
+	}
+
+	integrationURL = os.Getenv("CRATE_URL")
+	var container string
+	if integrationURL == "" {
+		var err error
+		container, integrationURL, err = startCrateDB()
+		if err != nil {
+			log.Fatalf("starting CrateDB container: %s", err)
+		}
+	}
+
+	res := m.Run()
+	if container != "" {
+		if out, err := exec.Command("docker", "rm", "-f", container).CombinedOutput(); err != nil {
+			log.Printf("removing CrateDB container %s: %s: %s", container, err, out)
+		}
+	}
+	os.Exit(res)
+}
+
+// startCrateDB starts a single node CrateDB container and waits until it
+// accepts connections. It returns the container id and a connection string.
+func startCrateDB() (string, string, error) {
+	image := os.Getenv("CRATE_IMAGE")
+	if image == "" {
+		image = "crate"
+	}
+	out, err := exec.Command(
+		"docker", "run", "-d", "-p", "127.0.0.1::5432", image,
+		"crate", "-Cdiscovery.type=single-node", "-Cnetwork.host=0.0.0.0",
+	).Output()
+	if err != nil {
+		return "", "", err
+	}
+	container := strings.TrimSpace(string(out))
+
+	out, err = exec.Command("docker", "port", container, "5432/tcp").Output()
+	if err != nil {
+		exec.Command("docker", "rm", "-f", container).Run()
+		return "", "", err
+	}
+	// docker port may list several bindings, one per line.
+	hostPort := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	url := "postgres://crate@" + hostPort + "/doc?sslmode=disable"
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		exec.Command("docker", "rm", "-f", container).Run()
+		return "", "", err
+	}
+	defer db.Close()
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		if err = db.Ping(); err == nil {
+			return container, url, nil
+		} else if time.Now().After(deadline) {
+			exec.Command("docker", "rm", "-f", container).Run()
+			return "", "", fmt.Errorf("CrateDB did not become ready: %s", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// integrationDB skips the test unless the integration tests are enabled and
+// otherwise returns a connection to CrateDB with the given table dropped.
+func integrationDB(t testing.TB, table string) *sql.DB {
+	if integrationURL == "" {
+		t.Skip("Skipping integration test, CRATE_INTEGRATION is not set")
+	}
+
+	db, err := sql.Open("postgres", integrationURL)
+	require.NoError(t, err)
+	_, err = db.Exec("DROP TABLE IF EXISTS " + escapeString(table, `"`))
+	require.NoError(t, err)
+	return db
+}
+
+func TestIntegrationRoundTrip(t *testing.T) {
+	table := "integration_round_trip"
+	db := integrationDB(t, table)
+	defer db.Close()
+
+	c := &CrateDB{
+		URL:              integrationURL,
+		Table:            table,
+		Timeout:          internal.Duration{Duration: time.Second * 30},
+		TableCreate:      true,
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 38,
+		DecimalScale:     10,
+		ReadinessQuery:   "SELECT 1",
+	}
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	now := time.Date(2017, 8, 7, 16, 44, 52, 123*1000*1000, time.UTC)
+	var metrics []telegraf.Metric
+	for i, test := range []struct {
+		Tags   map[string]string
+		Fields map[string]interface{}
+	}{
+		{
+			Tags:   map[string]string{"host": "a"},
+			Fields: map[string]interface{}{"int": int64(-42), "float": 1.5, "string": "foo"},
+		},
+		{
+			Tags:   map[string]string{"quote": `it's "quoted"`},
+			Fields: map[string]interface{}{"quote": `it's "quoted"`},
+		},
+		{
+			Tags:   map[string]string{"unicode": "日本語 ✓"},
+			Fields: map[string]interface{}{"unicode": "Grüße 🚀", "price": 12345.6789},
+		},
+	} {
+		m, err := metric.New("integration", test.Tags, test.Fields, now.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, c.Write(metrics))
+
+	_, err := db.Exec("REFRESH TABLE " + escapeString(table, `"`))
+	require.NoError(t, err)
+
+	for _, m := range metrics {
+		timestamp, err := escapeValue(m.Time())
+		require.NoError(t, err)
+
+		var name string
+		var tags, fields []byte
+		var price sql.NullString
+		row := db.QueryRow(
+			`SELECT "name", "tags", "fields", "price" FROM `+escapeString(table, `"`)+
+				` WHERE "hash_id" = $1 AND "timestamp" = `+timestamp,
+			int64(m.HashID()),
+		)
+		require.NoError(t, row.Scan(&name, &tags, &fields, &price))
+		require.Equal(t, m.Name(), name)
+		require.Equal(t, m.Tags(), decodeTags(t, tags))
+
+		wantFields := m.Fields()
+		if v, ok := wantFields["price"]; ok {
+			delete(wantFields, "price")
+			require.True(t, price.Valid)
+			require.Equal(t, fmt.Sprint(v), strings.TrimRight(strings.TrimRight(price.String, "0"), "."))
+		} else {
+			require.False(t, price.Valid)
+		}
+		require.Equal(t, normalizeFields(wantFields), decodeFields(t, fields))
+	}
+}
+
+func TestIntegrationNestedObject(t *testing.T) {
+	table := "integration_nested_object"
+	db := integrationDB(t, table)
+	defer db.Close()
+
+	c := &CrateDB{Table: table, TableCreate: true, Timeout: internal.Duration{Duration: 30 * time.Second}}
+	require.NoError(t, c.setup())
+	_, err := db.Exec(c.createSQL())
+	require.NoError(t, err)
+
+	nested := map[string]interface{}{
+		"outer": map[string]interface{}{
+			"inner": "it's {nested}",
+			"value": int64(7),
+		},
+	}
+	fields, err := escapeValue(nested)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO ` + escapeString(table, `"`) + ` ("hash_id", "timestamp", "name", "tags", "fields") ` +
+		`VALUES (1, '2017-08-07T16:44:52.123+0000', 'nested', {}, ` + fields + `)`)
+	require.NoError(t, err)
+	_, err = db.Exec("REFRESH TABLE " + escapeString(table, `"`))
+	require.NoError(t, err)
+
+	var got []byte
+	require.NoError(t, db.QueryRow(`SELECT "fields" FROM `+escapeString(table, `"`)+` WHERE "hash_id" = 1`).Scan(&got))
+	require.Equal(t, normalizeFields(nested), decodeFields(t, got))
+}
+
+func TestIntegrationJSONStringStorage(t *testing.T) {
+	table := "integration_json_string"
+	db := integrationDB(t, table)
+	defer db.Close()
+
+	c := &CrateDB{
+		URL:           integrationURL,
+		Table:         table,
+		Timeout:       internal.Duration{Duration: time.Second * 30},
+		TableCreate:   true,
+		TagsStorage:   "json_string",
+		FieldsStorage: "json_string",
+	}
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	m, err := metric.New(
+		"integration",
+		map[string]string{"quote": `it's "quoted"`},
+		map[string]interface{}{"int": int64(-42), "float": 1.5, "string": "Grüße 🚀"},
+		time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	_, err = db.Exec("REFRESH TABLE " + escapeString(table, `"`))
+	require.NoError(t, err)
+
+	var tags, fields string
+	require.NoError(t, db.QueryRow(`SELECT "tags", "fields" FROM `+escapeString(table, `"`)).Scan(&tags, &fields))
+	require.Equal(t, m.Tags(), decodeTags(t, []byte(tags)))
+	require.Equal(t, normalizeFields(m.Fields()), decodeFields(t, []byte(fields)))
+}
+
+// BenchmarkIntegrationSplitByDay writes batches spanning a week to measure
+// the effect of split_by_day, e.g.:
+//
+//   CRATE_INTEGRATION=1 go test -tags integration -run XXX -bench SplitByDay ./plugins/outputs/cratedb/
+func BenchmarkIntegrationSplitByDay(b *testing.B) {
+	start := time.Date(2017, 8, 7, 0, 0, 0, 0, time.UTC)
+	for _, split := range []bool{false, true} {
+		b.Run(fmt.Sprintf("split_by_day=%t", split), func(b *testing.B) {
+			table := "integration_split_by_day"
+			db := integrationDB(b, table)
+			defer db.Close()
+
+			c := &CrateDB{
+				URL:         integrationURL,
+				Table:       table,
+				Timeout:     internal.Duration{Duration: time.Second * 30},
+				TableCreate: true,
+				SplitByDay:  split,
+			}
+			require.NoError(b, c.Connect())
+			defer c.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				metrics := make([]telegraf.Metric, 0, 1000)
+				for j := 0; j < cap(metrics); j++ {
+					// Mixed timestamps spread across 7 days.
+					ts := start.Add(time.Duration(j%7)*24*time.Hour + time.Duration(i*cap(metrics)+j)*time.Millisecond)
+					m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": float64(j)}, ts)
+					require.NoError(b, err)
+					metrics = append(metrics, m)
+				}
+				require.NoError(b, c.Write(metrics))
+			}
+		})
+	}
+}
+
+// BenchmarkIntegrationSortRows writes time-skewed batches, as sent by agents
+// with delayed inputs, to measure the effect of sort_rows, e.g.:
+//
+//   CRATE_INTEGRATION=1 go test -tags integration -run XXX -bench SortRows ./plugins/outputs/cratedb/
+func BenchmarkIntegrationSortRows(b *testing.B) {
+	start := time.Date(2017, 8, 7, 0, 0, 0, 0, time.UTC)
+	for _, sorted := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sort_rows=%t", sorted), func(b *testing.B) {
+			table := "integration_sort_rows"
+			db := integrationDB(b, table)
+			defer db.Close()
+
+			c := &CrateDB{
+				URL:         integrationURL,
+				Table:       table,
+				Timeout:     internal.Duration{Duration: time.Second * 30},
+				TableCreate: true,
+				SortRows:    sorted,
+			}
+			require.NoError(b, c.Connect())
+			defer c.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				metrics := make([]telegraf.Metric, 0, 1000)
+				for j := 0; j < cap(metrics); j++ {
+					// Timestamps spread across 3 days in no particular order.
+					offset := time.Duration(j*7919%cap(metrics)) * 3 * 24 * time.Hour / time.Duration(cap(metrics))
+					ts := start.Add(offset + time.Duration(i)*time.Millisecond)
+					m, err := metric.New("cpu", map[string]string{"host": fmt.Sprint(j % 50)}, map[string]interface{}{"idle": float64(j)}, ts)
+					require.NoError(b, err)
+					metrics = append(metrics, m)
+				}
+				require.NoError(b, c.Write(metrics))
+			}
+		})
+	}
+}
+
+func decodeTags(t *testing.T, data []byte) map[string]string {
+	var tags map[string]string
+	require.NoError(t, json.Unmarshal(data, &tags))
+	return tags
+}
+
+// decodeFields decodes a JSON encoded OBJECT, keeping numbers as json.Number
+// so they can be compared with normalizeFields.
+func decodeFields(t *testing.T, data []byte) map[string]interface{} {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	require.NoError(t, dec.Decode(&fields))
+	return fields
+}
+
+// normalizeFields converts fields into the shape returned by decodeFields.
+func normalizeFields(fields map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			normalized[k] = normalizeFields(t)
+		case int64, float64:
+			normalized[k] = json.Number(fmt.Sprint(t))
+		default:
+			normalized[k] = v
+		}
+	}
+	return normalized
+}
@@ -1,15 +1,34 @@
 package cratedb
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/selfstat"
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
 
@@ -80,8 +99,9 @@ VALUES
 		},
 	}
 
+	c := &CrateDB{Table: "my_table"}
 	for _, test := range tests {
-		if got, err := insertSQL("my_table", test.Metrics, time.UTC); err != nil {
+		if got, err := c.insertSQL(test.Metrics, time.UTC); err != nil {
 			t.Error(err)
 		} else if got != test.Want {
 			t.Errorf("got:\n%s\n\nwant:\n%s", got, test.Want)
@@ -89,44 +109,2097 @@ VALUES
 	}
 }
 
-func Test_escapeValue(t *testing.T) {
+func Test_insertSQLDecimalColumns(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("trade", map[string]string{}, map[string]interface{}{"price": 0.1, "volume": int64(3)}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("trade", map[string]string{}, map[string]interface{}{"volume": int64(4)}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:            "my_table",
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 18,
+		DecimalScale:     4,
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m1, m2}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price")
+VALUES
+(`+fmt.Sprint(int64(m1.HashID()))+`, '2009-11-10T23:00:00+0000', 'trade', {}, {"volume" = 3}, 0.1) ,
+(`+fmt.Sprint(int64(m2.HashID()))+`, '2009-11-10T23:00:00+0000', 'trade', {}, {"volume" = 4}, NULL);
+`), got)
+
+	require.Contains(t, c.createSQL(), `"price" NUMERIC(18, 4),`)
+
+	invalid, err := metric.New("trade", map[string]string{}, map[string]interface{}{"price": "n/a"}, now)
+	require.NoError(t, err)
+	c.DecimalFallback = "error"
+	_, err = c.insertSQL([]telegraf.Metric{invalid}, time.UTC)
+	require.Error(t, err)
+
+	require.Error(t, (&CrateDB{DecimalColumns: []string{"price"}}).setup())
+	require.Error(t, (&CrateDB{DecimalColumns: []string{"tags"}, DecimalPrecision: 18}).setup())
+}
+
+func Test_insertSQLDropZeroFields(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("trade", map[string]string{}, map[string]interface{}{
+		"price":  0.0,
+		"volume": int64(0),
+		"bytes":  uint64(0),
+		"fee":    0.5,
+		"open":   false,
+		"status": "",
+	}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:            "my_table",
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 18,
+		DropZeroFields:   true,
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'trade', {}, {"fee" = 0.5, "open" = false, "status" = ''}, NULL);
+`), got)
+
+	c.DropZeroFields = false
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"bytes" = 0, "fee" = 0.5, "open" = false, "status" = '', "volume" = 0}, 0);`)
+}
+
+func TestWriteEmptyObjects(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	idle, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"idle": int64(0)}, now)
+	require.NoError(t, err)
+	busy, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": int64(1)}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:          "my_table",
+		Timeout:        internal.Duration{Duration: time.Second * 5},
+		DropZeroFields: true,
+		EmptyTags:      "store_null",
+		EmptyFields:    "store_null",
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{idle, busy}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(`+fmt.Sprint(int64(idle.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', NULL, NULL) ,
+(`+fmt.Sprint(int64(busy.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"idle" = 1});
+`), got)
+
+	c.EmptyTags = ""
+	c.EmptyFields = "store_empty"
+	got, err = c.insertSQL([]telegraf.Metric{idle}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `'cpu', {}, {});`)
+
+	for _, test := range []struct {
+		tags, fields string
+		want         int
+	}{
+		{"skip_metric", "", 1},
+		{"", "skip_metric", 1},
+		{"store_null", "store_null", 2},
+	} {
+		fd := &fakeDriver{}
+		c.EmptyTags = test.tags
+		c.EmptyFields = test.fields
+		require.NoError(t, c.setup())
+		c.DB = fd.open(t)
+		require.NoError(t, c.Write([]telegraf.Metric{idle, busy}))
+		require.Len(t, fd.statements(), 1)
+		require.Equal(t, test.want, strings.Count(fd.statements()[0], "'cpu'"), "%v", test)
+	}
+
+	c.EmptyFields = "drop"
+	require.Error(t, c.setup())
+}
+
+func TestWriteMaxFieldsPerMetric(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	wide, err := metric.New("wide", map[string]string{}, map[string]interface{}{"d": 4.0, "a": 1.0, "c": 3.0, "b": 2.0}, now)
+	require.NoError(t, err)
+	narrow, err := metric.New("narrow", map[string]string{}, map[string]interface{}{"a": 1.0}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:              "my_table",
+		Timeout:            internal.Duration{Duration: time.Second * 5},
+		MaxFieldsPerMetric: 2,
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{wide}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `'wide', {}, {"a" = 1, "b" = 2});`)
+
+	c.FieldLimitPolicy = "overflow"
+	require.NoError(t, c.setup())
+	require.Contains(t, c.createSQL(), `"fields_overflow" STRING,`)
+	got, err = c.insertSQL([]telegraf.Metric{wide, narrow}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "fields_overflow")
+VALUES
+(`+fmt.Sprint(int64(wide.HashID()))+`, '2009-11-10T23:00:00+0000', 'wide', {}, {"a" = 1, "b" = 2}, '{"c":3,"d":4}') ,
+(`+fmt.Sprint(int64(narrow.HashID()))+`, '2009-11-10T23:00:00+0000', 'narrow', {}, {"a" = 1}, NULL);
+`), got)
+
+	fd := &fakeDriver{}
+	c.FieldLimitPolicy = "skip"
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write([]telegraf.Metric{wide, narrow}))
+	require.Len(t, fd.statements(), 1)
+	require.NotContains(t, fd.statements()[0], "'wide'")
+	require.Contains(t, fd.statements()[0], "'narrow'")
+
+	c.FieldLimitPolicy = "split"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLMetadataTagPrefix(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"cpu",
+		map[string]string{"host": "a", "unit_usage": "percent", "unit_temp": "celsius"},
+		map[string]interface{}{"usage": 0.5, "temp": int64(40)},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", MetadataTagPrefix: "unit_"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "metadata")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"temp" = 40, "usage" = 0.5}, {"temp" = 'celsius', "usage" = 'percent'});
+`), got)
+	require.Contains(t, c.createSQL(), `"metadata" OBJECT(DYNAMIC),`)
+}
+
+func Test_insertSQLTagEnum(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, tags := range []map[string]string{
+		{"host": "a", "status": "warn"},
+		{"host": "b", "status": "unknown"},
+		{"host": "c"},
+	} {
+		m, err := metric.New("check", tags, map[string]interface{}{"value": int64(1)}, now)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	c := &CrateDB{
+		Table:   "my_table",
+		TagEnum: map[string]map[string]int{"status": {"ok": 0, "warn": 1, "crit": 2}},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL(metrics, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "status")
+VALUES
+(`+fmt.Sprint(int64(metrics[0].HashID()))+`, '2009-11-10T23:00:00+0000', 'check', {"host" = 'a'}, {"value" = 1}, 1) ,
+(`+fmt.Sprint(int64(metrics[1].HashID()))+`, '2009-11-10T23:00:00+0000', 'check', {"host" = 'b'}, {"value" = 1}, NULL) ,
+(`+fmt.Sprint(int64(metrics[2].HashID()))+`, '2009-11-10T23:00:00+0000', 'check', {"host" = 'c'}, {"value" = 1}, NULL);
+`), got)
+	require.Contains(t, c.createSQL(), `"status" INTEGER,`)
+
+	c.TagEnumUnknown = "default"
+	c.TagEnumDefault = -1
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL(metrics[1:2], time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"value" = 1}, -1);`)
+
+	c.TagEnumUnknown = "error"
+	require.NoError(t, c.setup())
+	_, err = c.insertSQL(metrics[1:2], time.UTC)
+	require.EqualError(t, err, `check: tag "status" has no code for value "unknown"`)
+
+	c.TagEnumUnknown = "ignore"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLAgentHostColumn(t *testing.T) {
+	defer func() { hostname = os.Hostname }()
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "remote"}, map[string]interface{}{"usage": 0.5}, now)
+	require.NoError(t, err)
+
+	hostname = func() (string, error) { return "collector", nil }
+	c := &CrateDB{Table: "my_table", AgentHostColumn: "agent_host"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "agent_host")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'remote'}, {"usage" = 0.5}, 'collector');
+`), got)
+	require.Contains(t, c.createSQL(), `"agent_host" STRING,`)
+
+	hostname = func() (string, error) { return "", errors.New("no host name") }
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"usage" = 0.5}, NULL);`)
+
+	c.AgentHostColumn = "tags"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLSeriesKeyColumn(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	a, err := metric.New("cpu", map[string]string{"host": "a", "cpu": "cpu0"}, map[string]interface{}{"usage": 0.5}, now)
+	require.NoError(t, err)
+	b, err := metric.New("cpu", map[string]string{"host": "b", "cpu": "cpu1"}, map[string]interface{}{"usage": 0.5}, now)
+	require.NoError(t, err)
+	bare, err := metric.New("up", nil, map[string]interface{}{"value": true}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", SeriesKeyColumn: "series_key", MetadataTagPrefix: "c"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{a, b, bare}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "metadata", "series_key")
+VALUES
+(`+fmt.Sprint(int64(a.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"usage" = 0.5}, {"pu" = 'cpu0'}, 'cpu,cpu,host') ,
+(`+fmt.Sprint(int64(b.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'b'}, {"usage" = 0.5}, {"pu" = 'cpu1'}, 'cpu,cpu,host') ,
+(`+fmt.Sprint(int64(bare.HashID()))+`, '2009-11-10T23:00:00+0000', 'up', {}, {"value" = true}, {}, 'up');
+`), got)
+	require.Contains(t, c.createSQL(), `"series_key" STRING,`)
+
+	c.SeriesKeyColumn = "name"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLExpiresColumn(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(tags map[string]string) telegraf.Metric {
+		m, err := metric.New("cpu", tags, map[string]interface{}{"usage": 0.5}, now)
+		require.NoError(t, err)
+		return m
+	}
+	week := newMetric(map[string]string{"retention": "1w"})
+	hours := newMetric(map[string]string{"retention": "36h"})
+	invalid := newMetric(map[string]string{"retention": "forever"})
+	none := newMetric(nil)
+
+	c := &CrateDB{
+		Table:          "my_table",
+		ExpiresColumn:  "expires_at",
+		ExpiresTag:     "retention",
+		ExpiresDefault: internal.Duration{Duration: 24 * time.Hour},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{week, hours, invalid, none}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "expires_at")
+VALUES
+(`+fmt.Sprint(int64(week.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"retention" = '1w'}, {"usage" = 0.5}, '2009-11-17T23:00:00+0000') ,
+(`+fmt.Sprint(int64(hours.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"retention" = '36h'}, {"usage" = 0.5}, '2009-11-12T11:00:00+0000') ,
+(`+fmt.Sprint(int64(invalid.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"retention" = 'forever'}, {"usage" = 0.5}, '2009-11-11T23:00:00+0000') ,
+(`+fmt.Sprint(int64(none.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {}, {"usage" = 0.5}, '2009-11-11T23:00:00+0000');
+`), got)
+	require.Contains(t, c.createSQL(), `"expires_at" TIMESTAMP,`)
+
+	// Without a default, metrics without a valid retention don't expire.
+	c.ExpiresDefault.Duration = 0
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{invalid}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"usage" = 0.5}, NULL);`)
+
+	c.ExpiresTag = ""
+	require.Error(t, c.setup())
+}
+
+func Test_parseRetention(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"7d":    7 * 24 * time.Hour,
+		"1.5d":  36 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"90m":   90 * time.Minute,
+		"1h30m": 90 * time.Minute,
+	} {
+		got, err := parseRetention(s)
+		require.NoError(t, err, s)
+		require.Equal(t, want, got, s)
+	}
+	for _, s := range []string{"", "d", "xd", "0d", "-1h", "7", "forever"} {
+		_, err := parseRetention(s)
+		require.Error(t, err, s)
+	}
+}
+
+func Test_insertSQLExtraColumns(t *testing.T) {
+	defer func() { hostname = os.Hostname }()
+	hostname = func() (string, error) { return "collector", nil }
+	os.Setenv("CRATEDB_TEST_DC", "dc1")
+	defer os.Unsetenv("CRATEDB_TEST_DC")
+
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage_count": int64(3), "idle_count": int64(1)}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table: "my_table",
+		ExtraColumns: map[string]string{
+			"env":         "prod",
+			"datacenter":  "${CRATEDB_TEST_DC}",
+			"collector":   "%h (100%%)",
+			"usage_count": "not a field",
+		},
+		LongColumnSuffixes: []string{"_count"},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	// "usage_count" is a constant column, so the field isn't promoted.
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "collector", "datacenter", "env", "usage_count", "idle_count")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"usage_count" = 3}, 'collector (100%)', 'dc1', 'prod', 'not a field', CAST(1 AS LONG));
+`), got)
+	require.Contains(t, c.createSQL(), `"datacenter" STRING,`)
+
+	for _, extra := range []map[string]string{
+		{"tags": "x"},
+		{"host": "%x"},
+		{"host": "100%"},
+	} {
+		c.ExtraColumns = extra
+		require.Error(t, c.setup(), "%v", extra)
+	}
+	hostname = func() (string, error) { return "", errors.New("no host name") }
+	c.ExtraColumns = map[string]string{"collector": "%h"}
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLJSONStringStorage(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"app",
+		map[string]string{"host": "a", "quote": `it's "quoted"`},
+		map[string]interface{}{"count": int64(3), "status": "ok", "up": true},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", FieldsStorage: "json_string"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'app', {"host" = 'a', "quote" = 'it''s "quoted"'}, '{"count":3,"status":"ok","up":true}');
+`), got)
+	require.Contains(t, c.createSQL(), `"tags" OBJECT(DYNAMIC),`)
+	require.Contains(t, c.createSQL(), `"fields" STRING,`)
+
+	c.TagsStorage = "json_string"
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `'app', '{"host":"a","quote":"it''s \"quoted\""}', '{"count":3,`)
+	require.Contains(t, c.createSQL(), `"tags" STRING,`)
+
+	c.TagsStorage = "text"
+	require.EqualError(t, c.setup(), `unknown tags_storage: "text"`)
+}
+
+func Test_insertSQLTagsArrayStorage(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("app", map[string]string{"host": "a", "dc": "eu"}, map[string]interface{}{"up": true}, now)
+	require.NoError(t, err)
+	empty, err := metric.New("app", nil, map[string]interface{}{"up": true}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", TagsStorage: "array"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m, empty}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'app', [{"key" = 'dc', "value" = 'eu'}, {"key" = 'host', "value" = 'a'}], {"up" = true}) ,
+(`+fmt.Sprint(int64(empty.HashID()))+`, '2009-11-10T23:00:00+0000', 'app', [], {"up" = true});
+`), got)
+	require.Contains(t, c.createSQL(), `"tags" ARRAY(OBJECT AS (key STRING, value STRING)),`)
+	require.Empty(t, schemaDiff(c.schema()[3:4], map[string]string{"tags": "object_array"}))
+
+	c.FieldsStorage = "array"
+	require.EqualError(t, c.setup(), `unknown fields_storage: "array"`)
+}
+
+func Test_insertSQLUnquotedIdentifiers(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage_count": int64(3), "Usage-Idle": 0.5}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:               "doc.my_table",
+		UnquotedIdentifiers: true,
+		LongColumnSuffixes:  []string{"_count"},
+		OnConflict:          "update",
+		UpdateColumns:       []string{"fields"},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO doc.my_table (hash_id, timestamp, name, tags, fields, usage_count)
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {host = 'a'}, {"Usage-Idle" = 0.5}, CAST(3 AS LONG))
+ON CONFLICT (timestamp, hash_id, day) DO UPDATE SET fields = excluded.fields;
+`), got)
+	require.Contains(t, c.createSQL(), `	day TIMESTAMP GENERATED ALWAYS AS date_trunc('day', timestamp),
+	PRIMARY KEY (timestamp, hash_id, day)
+) PARTITIONED BY (day) WITH (column_policy = 'dynamic');`)
+
+	for _, invalid := range []*CrateDB{
+		{Table: "Metrics", UnquotedIdentifiers: true},
+		{Table: `"metrics"`, UnquotedIdentifiers: true},
+		{Table: "metrics", UnquotedIdentifiers: true, MetadataTagPrefix: "unit_", AgentHostColumn: "Agent"},
+		{Table: "metrics", UnquotedIdentifiers: true, DecimalColumns: []string{"order"}, DecimalPrecision: 10},
+	} {
+		require.Error(t, invalid.setup(), "%+v", invalid)
+	}
+}
+
+func Test_insertSQLTZOffsetColumn(t *testing.T) {
+	winter, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"idle": 0.5}, time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	summer, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"idle": 0.5}, time.Date(2009, time.July, 10, 23, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", TZOffsetColumn: "tz_offset_minutes", Timezone: "America/New_York"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{winter, summer}, c.location())
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "tz_offset_minutes")
+VALUES
+(`+fmt.Sprint(int64(winter.HashID()))+`, '2009-11-10T18:00:00-0500', 'cpu', {}, {"idle" = 0.5}, -300) ,
+(`+fmt.Sprint(int64(summer.HashID()))+`, '2009-07-10T19:00:00-0400', 'cpu', {}, {"idle" = 0.5}, -240);
+`), got)
+	require.Contains(t, c.createSQL(), `"tz_offset_minutes" INTEGER,`)
+
+	c.TZOffsetColumn = "timestamp"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLOriginColumn(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("cpu", map[string]string{"host": "a", "input": "cpu"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", OriginColumn: "origin", OriginTag: "input"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m1, m2}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "origin")
+VALUES
+(`+fmt.Sprint(int64(m1.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"idle" = 0.5}, 'cpu') ,
+(`+fmt.Sprint(int64(m2.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"idle" = 0.5}, NULL);
+`), got)
+	require.Contains(t, c.createSQL(), `"origin" STRING,`)
+
+	c.OriginTag = ""
+	require.Error(t, c.setup())
+	c.OriginColumn = "name"
+	c.OriginTag = "input"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLTypeSuffixKeys(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"app",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"count": int64(3), "latency": 1.5, "status": "ok", "up": true, "price": 2.5},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:            "my_table",
+		TypeSuffixKeys:   true,
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 10,
+		DecimalScale:     2,
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'app', {"host" = 'a'}, {"count_i" = 3, "latency_f" = 1.5, "status_s" = 'ok', "up_b" = true}, 2.5);
+`), got)
+}
+
+func Test_insertSQLNumericObjectCoercion(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"app",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"count": int64(3), "latency": 1.5, "whole": 2.0, "big": 1e21, "status": "ok", "up": true},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", NumericObjectCoercion: "double"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"big" = 1e+21, "count" = 3.0, "latency" = 1.5, "status" = 'ok', "up" = true, "whole" = 2.0}`)
+
+	c.FieldsStorage = "json_string"
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `'{"big":1e+21,"count":3.0,"latency":1.5,"status":"ok","up":true,"whole":2.0}'`)
+
+	c.FieldsStorage = ""
+	c.TypeSuffixKeys = true
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `"count_f" = 3.0,`)
+
+	c.TypeSuffixKeys = false
+	c.NumericObjectCoercion = "long"
+	require.NoError(t, c.setup())
+	_, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.EqualError(t, err, `field "big" can't be stored as LONG: 1e+21`)
+	// RemoveField can corrupt the serialized fields of this metric
+	// implementation, so the metric is created again instead.
+	m, err = metric.New(
+		"app",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"count": int64(3), "latency": 1.5, "whole": 2.0, "status": "ok", "up": true},
+		now,
+	)
+	require.NoError(t, err)
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"count" = 3, "latency" = 1, "status" = 'ok', "up" = true, "whole" = 2}`)
+
+	c.NumericObjectCoercion = "float"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLKeyRewrite(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"app",
+		map[string]string{"host.name": "a", "host_name": "b", "dc.zone": "x"},
+		map[string]interface{}{"disk.used": int64(3), "disk-used": int64(4), "cost.total": 2.5},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table: "my_table",
+		KeyRewrite: []KeyRewrite{
+			{Pattern: `[.-]`, Replacement: "_"},
+		},
+		DecimalColumns:   []string{"cost_total"},
+		DecimalPrecision: 10,
+		DecimalScale:     2,
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	// "host_name" isn't changed and wins over "host.name", "disk-used" sorts
+	// before "disk.used".
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "cost_total")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'app', {"dc_zone" = 'x', "host_name" = 'b'}, {"disk_used" = 4}, 2.5);
+`), got)
+
+	c.KeyRewrite = []KeyRewrite{{Pattern: "("}}
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLMaxKeyLength(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"app",
+		map[string]string{"host": "a", "datacenter_zone": "x"},
+		map[string]interface{}{"usage_total": int64(1), "usage_total_2": int64(2), "abcdefghiü": int64(3)},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", MaxKeyLength: 10}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	// "usage_total" and "usage_total_2" collide after truncation, the first
+	// one in sorted order wins. "abcdefghiü" is cut before the "ü".
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'app', {"datacenter" = 'x', "host" = 'a'}, {"abcdefghi" = 3, "usage_tota" = 1});
+`), got)
+
+	c.KeyLengthPolicy = "skip"
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `{"host" = 'a'}, {});`)
+
+	// Promoted columns have to fit as well.
+	c.DecimalColumns = []string{"usage_total"}
+	c.DecimalPrecision = 10
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLKeyCollisionPolicy(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	rewritten, err := metric.New(
+		"app",
+		map[string]string{"host.name": "a", "host_name": "b"},
+		map[string]interface{}{"disk.used": int64(3), "disk-used": int64(4)},
+		now,
+	)
+	require.NoError(t, err)
+	truncated, err := metric.New(
+		"app",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"usage_total": int64(1), "usage_total_2": int64(2)},
+		now,
+	)
+	require.NoError(t, err)
+	objects := func(got string) string {
+		return got[strings.Index(got, "'app', ")+len("'app', ") : strings.LastIndex(got, ");")]
+	}
+
+	for _, test := range []struct {
+		Policy    string
+		Rewritten string
+		Truncated string
+	}{
+		{"", `{"host_name" = 'b'}, {"disk_used" = 4}`, `{"host" = 'a'}, {"usage_tota" = 1}`},
+		{"first", `{"host_name" = 'b'}, {"disk_used" = 4}`, `{"host" = 'a'}, {"usage_tota" = 1}`},
+		{"last", `{"host_name" = 'a'}, {"disk_used" = 3}`, `{"host" = 'a'}, {"usage_tota" = 2}`},
+		{"suffix", `{"host_name" = 'b', "host_name_2" = 'a'}, {"disk_used" = 4, "disk_used_2" = 3}`, `{"host" = 'a'}, {"usage_to_2" = 2, "usage_tota" = 1}`},
+	} {
+		c := &CrateDB{
+			Table:              "my_table",
+			KeyRewrite:         []KeyRewrite{{Pattern: `[.-]`, Replacement: "_"}},
+			KeyCollisionPolicy: test.Policy,
+		}
+		require.NoError(t, c.setup(), test.Policy)
+		got, err := c.insertSQL([]telegraf.Metric{rewritten}, time.UTC)
+		require.NoError(t, err, test.Policy)
+		require.Equal(t, test.Rewritten, objects(got), test.Policy)
+
+		c = &CrateDB{Table: "my_table", MaxKeyLength: 10, KeyCollisionPolicy: test.Policy}
+		require.NoError(t, c.setup(), test.Policy)
+		got, err = c.insertSQL([]telegraf.Metric{truncated}, time.UTC)
+		require.NoError(t, err, test.Policy)
+		require.Equal(t, test.Truncated, objects(got), test.Policy)
+	}
+
+	c := &CrateDB{
+		Table:              "my_table",
+		KeyRewrite:         []KeyRewrite{{Pattern: `[.-]`, Replacement: "_"}},
+		KeyCollisionPolicy: "error",
+	}
+	require.NoError(t, c.setup())
+	_, err = c.insertSQL([]telegraf.Metric{rewritten}, time.UTC)
+	require.Error(t, err)
+	c = &CrateDB{Table: "my_table", MaxKeyLength: 10, KeyCollisionPolicy: "error"}
+	require.NoError(t, c.setup())
+	_, err = c.insertSQL([]telegraf.Metric{truncated}, time.UTC)
+	require.Error(t, err)
+
+	c.KeyCollisionPolicy = "merge"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLChecksumColumn(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+	row := fmt.Sprint(int64(m.HashID())) + `, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"idle" = 0.5}`
+	h := fnv.New64a()
+	h.Write([]byte(row))
+
+	for _, test := range []struct {
+		algorithm string
+		typ       string
+		want      string
+	}{
+		{"", "LONG INDEX OFF", fmt.Sprint(int64(h.Sum64()))},
+		{"crc32", "LONG INDEX OFF", fmt.Sprint(crc32.ChecksumIEEE([]byte(row)))},
+		{"sha256", "STRING INDEX OFF", fmt.Sprintf("'%x'", sha256.Sum256([]byte(row)))},
+	} {
+		c := &CrateDB{Table: "my_table", ChecksumColumn: "checksum", ChecksumAlgorithm: test.algorithm}
+		require.NoError(t, c.setup())
+		require.Contains(t, c.createSQL(), `"checksum" `+test.typ+",")
+		got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "checksum")
+VALUES
+(`+row+`, `+test.want+`);
+`), got, test.algorithm)
+	}
+
+	// The checksum is computed over the values without the casts of
+	// explicit_casts.
+	c := &CrateDB{Table: "my_table", ChecksumColumn: "checksum", ExtraColumns: map[string]string{"dc": "eu"}, ExplicitCasts: true}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	h = fnv.New64a()
+	h.Write([]byte(row + `, 'eu'`))
+	require.Contains(t, got, `CAST('eu' AS `)
+	require.True(t, strings.HasSuffix(got, `, `+fmt.Sprint(int64(h.Sum64()))+`);`), got)
+
+	c = &CrateDB{Table: "my_table", ChecksumColumn: "checksum", ChecksumAlgorithm: "xxhash"}
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLFieldObjectSchema(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"cpu",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"usage_idle": 0.5, "cores": int64(4)},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:             "my_table",
+		FieldObjectSchema: map[string]string{"usage_idle": "DOUBLE"},
+	}
+	require.NoError(t, c.setup())
+	_, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.Error(t, err)
+	require.IsType(t, &metricError{}, err)
+
+	c.FieldObjectUnknown = "extra"
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "fields_extra")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {"host" = 'a'}, {"usage_idle" = 0.5}, {"cores" = 4});
+`), got)
+}
+
+func Test_insertSQLOnConflictUpdate(t *testing.T) {
+	c := &CrateDB{Table: "my_table", OnConflict: "update", MetadataTagPrefix: "unit_"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL(testutil.MockMetrics(), time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "metadata")
+VALUES
+(1845393540509842047, '2009-11-10T23:00:00+0000', 'test1', {"tag1" = 'value1'}, {"value" = 1}, {})
+ON CONFLICT ("timestamp", "hash_id", "day") DO UPDATE SET "name" = excluded."name", "tags" = excluded."tags", "fields" = excluded."fields", "metadata" = excluded."metadata";
+`), got)
+
+	c.UpdateColumns = []string{"fields"}
+	require.NoError(t, c.setup())
+	got, err = c.insertSQL(testutil.MockMetrics(), time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `DO UPDATE SET "fields" = excluded."fields";`)
+
+	c.UpdateColumns = []string{"timestamp"}
+	require.Error(t, c.setup())
+	c.UpdateColumns = []string{"missing"}
+	require.Error(t, c.setup())
+	require.Error(t, (&CrateDB{OnConflict: "ignore"}).setup())
+}
+
+func Test_insertSQLIdempotent(t *testing.T) {
+	c := &CrateDB{Table: "my_table", PrimaryKeyName: true, Idempotent: true}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL(testutil.MockMetrics(), time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(1845393540509842047, '2009-11-10T23:00:00+0000', 'test1', {"tag1" = 'value1'}, {"value" = 1})
+ON CONFLICT ("timestamp", "hash_id", "name", "day") DO NOTHING;
+`), got)
+	require.Contains(t, c.createSQL(), `PRIMARY KEY ("timestamp", "hash_id", "name", "day")`)
+
+	c.OnConflict = "update"
+	require.Error(t, c.setup())
+	c.OnConflict = ""
+	c.VerifyRowCount = true
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLExplicitCasts(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("trade", map[string]string{"unit_price": "EUR"}, map[string]interface{}{"price": 0.1, "volume": int64(3)}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:             "my_table",
+		DecimalColumns:    []string{"price"},
+		DecimalPrecision:  18,
+		DecimalScale:      4,
+		MetadataTagPrefix: "unit_",
+		ExplicitCasts:     true,
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price", "metadata")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'trade', {}, {"volume" = 3}, CAST(0.1 AS NUMERIC(18, 4)), CAST({"price" = 'EUR'} AS OBJECT(DYNAMIC)));
+`), got)
+}
+
+func Test_insertSQLLongColumnSuffixes(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"usage_count": int64(3), "usage_mean": 0.5, "tags": int64(1)}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"idle_count": 4.0, "label_count": "n/a"}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", LongColumnSuffixes: []string{"_count"}, OnConflict: "update"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m1, m2}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "idle_count", "usage_count")
+VALUES
+(`+fmt.Sprint(int64(m1.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {}, {"tags" = 1, "usage_mean" = 0.5}, CAST(NULL AS LONG), CAST(3 AS LONG)) ,
+(`+fmt.Sprint(int64(m2.HashID()))+`, '2009-11-10T23:00:00+0000', 'cpu', {}, {"label_count" = 'n/a'}, CAST(4 AS LONG), CAST(NULL AS LONG))
+ON CONFLICT ("timestamp", "hash_id", "day") DO UPDATE SET "name" = excluded."name", "tags" = excluded."tags", "fields" = excluded."fields", "idle_count" = excluded."idle_count", "usage_count" = excluded."usage_count";
+`), got)
+	require.True(t, strings.HasSuffix(c.createSQL(), `) PARTITIONED BY ("day") WITH (column_policy = 'dynamic');`))
+}
+
+func Test_insertSQLColumnAlias(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("shop", map[string]string{}, map[string]interface{}{"order": 12.5, "group_count": int64(3), "index": int64(1)}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:              "my_table",
+		DecimalColumns:     []string{"order"},
+		DecimalPrecision:   10,
+		DecimalScale:       2,
+		LongColumnSuffixes: []string{"_count"},
+		ColumnAlias:        map[string]string{"order": "order_total", "group_count": "group_size"},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "order_total", "group_size")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'shop', {}, {"index" = 1}, 12.5, CAST(3 AS LONG));
+`), got)
+	require.Contains(t, c.createSQL(), `"order_total" NUMERIC(10, 2),`)
+
+	for _, alias := range []map[string]string{
+		{"order": ""},
+		{"order": "timestamp"},
+		{"order": "x", "group_count": "x"},
+		{"group_count": "order"},
+	} {
+		c.ColumnAlias = alias
+		require.Error(t, c.setup(), "%v", alias)
+	}
+}
+
+func Test_insertSQLUnnest(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "b"}, map[string]interface{}{"idle": 0.25, "price": int64(2)}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:            "my_table",
+		InsertStyle:      "unnest",
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 10,
+		OnConflict:       "update",
+		UpdateColumns:    []string{"fields"},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m1, m2}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price")
+(SELECT * FROM unnest([`+fmt.Sprint(int64(m1.HashID()))+`, `+fmt.Sprint(int64(m2.HashID()))+`],
+['2009-11-10T23:00:00+0000', '2009-11-10T23:00:00+0000'],
+['cpu', 'cpu'],
+[{"host" = 'a'}, {"host" = 'b'}],
+[{"idle" = 0.5}, {"idle" = 0.25}],
+[NULL, 2]))
+ON CONFLICT ("timestamp", "hash_id", "day") DO UPDATE SET "fields" = excluded."fields";
+`), got)
+
+	require.Error(t, (&CrateDB{InsertStyle: "copy"}).setup())
+}
+
+func Test_toDecimal(t *testing.T) {
+	tests := []struct {
+		Val  interface{}
+		Want decimal
+		OK   bool
+	}{
+		{int64(-42), "-42", true},
+		{123, "123", true},
+		{0.1, "0.1", true},
+		{1e21, "1000000000000000000000", true},
+		{math.NaN(), "", false},
+		{math.Inf(1), "", false},
+		{json.Number("12345678901234567890.123456789"), "12345678901234567890.123456789", true},
+		{json.Number("1e3"), "1000", true},
+		{json.Number("foo"), "", false},
+		{big.NewRat(1, 8), "0.125", true},
+		{"1.5", "", false},
+		{true, "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := toDecimal(test.Val)
+		require.Equal(t, test.OK, ok, "val: %#v", test.Val)
+		require.Equal(t, test.Want, got, "val: %#v", test.Val)
+	}
+}
+
+func Test_missingTimestamps(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, ts := range []time.Time{now.Add(-time.Minute), {}, time.Unix(0, 0)} {
+		m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, ts)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	c := &CrateDB{}
+	got, err := c.missingTimestamps(metrics[:1], now)
+	require.NoError(t, err)
+	require.Equal(t, metrics[:1], got)
+
+	got, err = c.missingTimestamps(metrics, now)
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	require.Equal(t, metrics[0], got[0])
+	for _, m := range got[1:] {
+		require.Equal(t, now.UnixNano(), m.UnixNano())
+		require.Equal(t, metrics[0].Tags(), m.Tags())
+		require.Equal(t, metrics[0].Fields(), m.Fields())
+	}
+
+	c.MissingTimestamp = "skip"
+	got, err = c.missingTimestamps(metrics, now)
+	require.NoError(t, err)
+	require.Equal(t, metrics[:1], got)
+	got, err = c.missingTimestamps(metrics[1:], now)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	c.MissingTimestamp = "error"
+	_, err = c.missingTimestamps(metrics, now)
+	require.EqualError(t, err, "cpu: metric has no timestamp")
+
+	c.MissingTimestamp = "guess"
+	require.Error(t, c.setup())
+}
+
+func Test_dropStale(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, age := range []time.Duration{0, 24 * time.Hour, 24*time.Hour + time.Second, -time.Minute} {
+		m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now.Add(-age))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	c := &CrateDB{MaxMetricAge: internal.Duration{Duration: 24 * time.Hour}}
+	got := c.dropStale(metrics, now)
+	require.Equal(t, []telegraf.Metric{metrics[0], metrics[1], metrics[3]}, got)
+	require.Len(t, metrics, 4)
+	require.Empty(t, c.dropStale(metrics[2:3], now))
+
+	// The age is checked when writing, so old metrics are never sent.
+	fd := &fakeDriver{}
+	c.Table = "my_table"
+	c.Timeout = internal.Duration{Duration: time.Second * 5}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(metrics))
+	require.Empty(t, fd.statements())
+}
+
+func TestWriteTimestampRound(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, offset := range []time.Duration{4 * time.Second, 6 * time.Second, 14 * time.Second} {
+		m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now.Add(offset))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:           "my_table",
+		Timeout:         internal.Duration{Duration: time.Second * 5},
+		TimestampRound:  internal.Duration{Duration: 10 * time.Second},
+		MergeSameSeries: true,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(metrics))
+	stmts := fd.statements()
+	require.Len(t, stmts, 1)
+	// The metrics rounded to the same timestamp are merged.
+	require.Contains(t, stmts[0], "'2009-11-10T23:00:00+0000', 'cpu'")
+	require.Contains(t, stmts[0], "'2009-11-10T23:00:10+0000', 'cpu'")
+	require.Equal(t, 2, strings.Count(stmts[0], "'cpu'"))
+	require.Equal(t, now.Add(4*time.Second), metrics[0].Time().UTC())
+
+	c.TimestampRoundMode = "truncate"
+	require.NoError(t, c.setup())
+	require.Equal(t, now.Add(10*time.Second), c.roundTime(now.Add(14*time.Second)).UTC())
+
+	// Days are rounded in the timezone of the timestamps, so they end up
+	// in the partition of their day there.
+	c.Timezone = "Europe/Berlin"
+	c.TimestampRound = internal.Duration{Duration: 24 * time.Hour}
+	require.NoError(t, c.setup())
+	require.Equal(t, time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), c.roundTime(now.Add(30*time.Minute)).UTC())
+
+	c.TimestampRoundMode = "ceil"
+	require.Error(t, c.setup())
+	c.TimestampRoundMode = ""
+	c.TimestampRound = internal.Duration{Duration: -time.Second}
+	require.Error(t, c.setup())
+}
+
+func TestWriteAlignTimestamps(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 59, 58, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for i, offset := range []time.Duration{0, 5 * time.Second, time.Second} {
+		m, err := metric.New("cpu", map[string]string{"cpu": fmt.Sprint(i)}, map[string]interface{}{"idle": 0.5}, now.Add(offset))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	// A second metric of a series is merged into the first one, as both get
+	// the same timestamp.
+	m, err := metric.New("cpu", map[string]string{"cpu": "0"}, map[string]interface{}{"user": 0.25}, now.Add(2*time.Second))
+	require.NoError(t, err)
+	metrics = append(metrics, m)
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:           "my_table",
+		Timeout:         internal.Duration{Duration: time.Second * 5},
+		SplitByDay:      true,
+		AlignTimestamps: true,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(metrics))
+	// The batch spanned two days, but is written to the partition of the
+	// latest timestamp.
+	stmts := fd.statements()
+	require.Len(t, stmts, 1)
+	require.Equal(t, 3, strings.Count(stmts[0], "'2009-11-11T00:00:03+0000', 'cpu'"))
+	require.Contains(t, stmts[0], `{"cpu" = '0'}, {"idle" = 0.5, "user" = 0.25}`)
+
+	// The common timestamp is rounded by timestamp_round.
+	c.TimestampRound = internal.Duration{Duration: time.Minute}
+	c.TimestampRoundMode = "truncate"
+	require.NoError(t, c.setup())
+	require.NoError(t, c.Write(metrics))
+	stmts = fd.statements()
+	require.Len(t, stmts, 2)
+	require.Equal(t, 3, strings.Count(stmts[1], "'2009-11-11T00:00:00+0000', 'cpu'"))
+}
+
+func TestWriteSplitByDay(t *testing.T) {
+	day := time.Date(2009, time.November, 10, 0, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, ts := range []time.Time{
+		day.Add(23 * time.Hour),
+		day.Add(24 * time.Hour),
+		day.Add(time.Hour),
+		day.Add(-time.Nanosecond),
+		// 2009-11-10T23:30:00 UTC
+		time.Date(2009, time.November, 11, 1, 30, 0, 0, time.FixedZone("CEST", 2*3600)),
+	} {
+		m, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"idle": 0.5}, ts)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.Equal(t, [][]telegraf.Metric{
+		{metrics[0], metrics[2], metrics[4]},
+		{metrics[1]},
+		{metrics[3]},
+	}, groupByDay(metrics, time.UTC))
+
+	fd := &fakeDriver{}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 1)
+
+	c.SplitByDay = true
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 4)
+
+	// Unpartitioned tables are written with a single statement anyway.
+	c.DisablePartition = true
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 5)
+}
+
+func Test_mergeSameSeries(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(name string, tags map[string]string, fields map[string]interface{}, ts time.Time) telegraf.Metric {
+		m, err := metric.New(name, tags, fields, ts)
+		require.NoError(t, err)
+		return m
+	}
+
+	metrics := []telegraf.Metric{
+		newMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 1.0}, now),
+		newMetric("mem", map[string]string{"host": "a"}, map[string]interface{}{"free": int64(1)}, now),
+		newMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"busy": 2.0}, now),
+		newMetric("cpu", map[string]string{"host": "b"}, map[string]interface{}{"busy": 3.0}, now),
+		newMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"busy": 4.0}, now.Add(time.Second)),
+		newMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 5.0}, now),
+	}
+	merged, err := mergeSameSeries(metrics)
+	require.NoError(t, err)
+	require.Len(t, merged, 4)
+
+	require.Equal(t, "cpu", merged[0].Name())
+	require.Equal(t, map[string]string{"host": "a"}, merged[0].Tags())
+	require.Equal(t, map[string]interface{}{"idle": 5.0, "busy": 2.0}, merged[0].Fields())
+	require.Equal(t, now.UnixNano(), merged[0].UnixNano())
+	require.Equal(t, metrics[1], merged[1])
+	require.Equal(t, metrics[3], merged[2])
+	require.Equal(t, metrics[4], merged[3])
+}
+
+func Test_hashID(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("cpu", map[string]string{"host": "a", "cpu": "0"}, map[string]interface{}{"value": 1}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "a", "cpu": "1"}, map[string]interface{}{"value": 1}, now)
+	require.NoError(t, err)
+	m3, err := metric.New("mem", map[string]string{"host": "a", "cpu": "0"}, map[string]interface{}{"value": 1}, now)
+	require.NoError(t, err)
+
+	telegrafMode := &CrateDB{HashMode: "telegraf"}
+	require.Equal(t, int64(m1.HashID()), telegrafMode.hashID(m1))
+	require.Equal(t, int64(m1.HashID()), (&CrateDB{}).hashID(m1))
+
+	noneMode := &CrateDB{HashMode: "none"}
+	require.Equal(t, int64(0), noneMode.hashID(m1))
+
+	allTags := &CrateDB{HashMode: "tags"}
+	require.NotEqual(t, allTags.hashID(m1), allTags.hashID(m2))
+	require.NotEqual(t, allTags.hashID(m1), allTags.hashID(m3))
+
+	hostOnly := &CrateDB{HashMode: "tags", HashTags: []string{"host", "missing"}}
+	require.Equal(t, hostOnly.hashID(m1), hostOnly.hashID(m2))
+	require.NotEqual(t, hostOnly.hashID(m1), hostOnly.hashID(m3))
+	// The order of hash_tags must not matter.
+	reversed := &CrateDB{HashMode: "tags", HashTags: []string{"missing", "host"}}
+	require.Equal(t, hostOnly.hashID(m1), reversed.hashID(m1))
+}
+
+func Test_hashIDString(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m1, err := metric.New("cpu", map[string]string{"host": "a", "cpu": "0"}, map[string]interface{}{"value": 1}, now)
+	require.NoError(t, err)
+	m2, err := metric.New("cpu", map[string]string{"host": "a", "cpu": "1"}, map[string]interface{}{"value": 1}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", HashIDType: "string"}
+	require.NoError(t, c.setup())
+	id1, ok := c.hashIDValue(m1).(string)
+	require.True(t, ok)
+	require.Len(t, id1, 32)
+	require.NotEqual(t, id1, c.hashIDValue(m2))
+	require.Equal(t, id1, (&CrateDB{HashIDType: "string", HashMode: "tags"}).hashIDValue(m1))
+	hostOnly := &CrateDB{HashIDType: "string", HashMode: "tags", HashTags: []string{"host"}}
+	require.Equal(t, hostOnly.hashIDValue(m1), hostOnly.hashIDValue(m2))
+	require.Equal(t, "", (&CrateDB{HashIDType: "string", HashMode: "none"}).hashIDValue(m1))
+	require.Equal(t, int64(m1.HashID()), (&CrateDB{}).hashIDValue(m1))
+
+	got, err := c.insertSQL([]telegraf.Metric{m1}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, "\n('"+id1+"', '2009-11-10T23:00:00+0000', 'cpu', ")
+	require.Contains(t, c.createSQL(), `"hash_id" STRING INDEX OFF,`)
+
+	c.HashIDType = "uuid"
+	require.Error(t, c.setup())
+}
+
+func Test_hashIDEncodingHex(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": 1}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", HashIDEncoding: "hex"}
+	require.NoError(t, c.setup())
+	id := fmt.Sprintf("%016x", m.HashID())
+	require.Equal(t, id, c.hashIDValue(m))
+	require.Equal(t, "0000000000000000", (&CrateDB{HashIDEncoding: "hex", HashMode: "none"}).hashIDValue(m))
+
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, "\n('"+id+"', '2009-11-10T23:00:00+0000', 'cpu', ")
+	require.Contains(t, c.createSQL(), `"hash_id" STRING INDEX OFF,`)
+	require.Contains(t, (&CrateDB{Table: "my_table", HashIDEncoding: "signed"}).createSQL(), `"hash_id" LONG INDEX OFF,`)
+
+	// Hashes are sorted unsigned, like the hex strings.
+	var metrics []telegraf.Metric
+	for i := 0; i < 20; i++ {
+		m, err := metric.New("cpu", map[string]string{"host": fmt.Sprint(i)}, map[string]interface{}{"value": 1}, now)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	sorted := c.sortByPrimaryKey(metrics)
+	for i := 1; i < len(sorted); i++ {
+		require.True(t, c.hashIDValue(sorted[i-1]).(string) < c.hashIDValue(sorted[i]).(string))
+	}
+
+	c.HashIDType = "string"
+	require.NoError(t, c.setup())
+	c.HashIDEncoding = "signed"
+	require.Error(t, c.setup())
+	c.HashIDType = ""
+	c.HashIDEncoding = "base64"
+	require.Error(t, c.setup())
+}
+
+func Test_insertSQLDocumentID(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(tags map[string]string, fields map[string]interface{}, tm time.Time) telegraf.Metric {
+		m, err := metric.New("config", tags, fields, tm)
+		require.NoError(t, err)
+		return m
+	}
+	m1 := newMetric(map[string]string{"host": "a", "agent": "1.4"}, map[string]interface{}{"path": "/etc/app.conf", "size": 10}, now)
+	m2 := newMetric(map[string]string{"host": "a", "agent": "1.5"}, map[string]interface{}{"path": "/etc/app.conf", "size": 12}, now.Add(time.Hour))
+	m3 := newMetric(map[string]string{"host": "a"}, map[string]interface{}{"path": "/etc/other.conf", "size": 10}, now)
+	m4 := newMetric(map[string]string{"host": "a", "path": "/etc/app.conf"}, map[string]interface{}{"size": 10}, now)
+
+	c := &CrateDB{Table: "my_table", DisablePartition: true, OnConflict: "update", HashMode: "document", DocumentIDKeys: []string{"host", "path"}}
+	require.NoError(t, c.setup())
+	require.Equal(t, c.hashIDValue(m1), c.hashIDValue(m2))
+	require.NotEqual(t, c.hashIDValue(m1), c.hashIDValue(m3))
+	require.NotEqual(t, c.hashIDValue(m1), c.hashIDValue(m4))
+	require.NotEqual(t, c.hashIDValue(m1), (&CrateDB{HashMode: "document", DocumentIDKeys: []string{"host"}}).hashIDValue(m1))
+
+	got, err := c.insertSQL([]telegraf.Metric{m1}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(`+fmt.Sprint(c.hashIDValue(m1))+`, '2009-11-10T23:00:00+0000', 'config', {"agent" = '1.4', "host" = 'a'}, {"path" = '/etc/app.conf', "size" = 10})
+ON CONFLICT ("hash_id") DO UPDATE SET "timestamp" = excluded."timestamp", "name" = excluded."name", "tags" = excluded."tags", "fields" = excluded."fields";
+`), got)
+	require.Contains(t, c.createSQL(), "PRIMARY KEY (\"hash_id\")\n);")
+
+	c.HashIDType = "string"
+	id, ok := c.hashIDValue(m1).(string)
+	require.True(t, ok)
+	require.Len(t, id, 32)
+	require.Equal(t, id, c.hashIDValue(m2))
+
+	c.DocumentIDKeys = nil
+	require.Error(t, c.setup())
+	c.HashMode = "tags"
+	c.DocumentIDKeys = []string{"host"}
+	require.Error(t, c.setup())
+}
+
+func TestWriteMaxBatchMemory(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for i := 0; i < 10; i++ {
+		m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	c.batchMemoryPeak.Set(0)
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 1)
+	// All rows have the same size.
+	rowMemory := c.batchMemoryPeak.Get() / 10
+	require.Equal(t, 10*rowMemory, c.batchMemoryPeak.Get())
+
+	c.MaxBatchMemory = 3*rowMemory + 1
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 5)
+	for i, want := range []int{3, 3, 3, 1} {
+		require.Equal(t, want, strings.Count(fd.statements()[1+i], "'cpu'"))
+	}
+
+	// A row that exceeds the limit on its own is still written.
+	c.MaxBatchMemory = 1
+	require.NoError(t, c.Write(metrics[:2]))
+	require.Len(t, fd.statements(), 7)
+
+	// Promoted fields only become columns of the statement of their row.
+	c.LongColumnSuffixes = []string{"_count"}
+	require.NoError(t, c.setup())
+	counted, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle_count": int64(3)}, now)
+	require.NoError(t, err)
+	require.NoError(t, c.Write([]telegraf.Metric{metrics[0], counted}))
+	stmts := fd.statements()[7:]
+	require.Len(t, stmts, 2)
+	require.NotContains(t, stmts[0], `"idle_count"`)
+	require.Contains(t, stmts[1], `"idle_count"`)
+}
+
+func TestWriteSortRows(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(host string, offset time.Duration) telegraf.Metric {
+		m, err := metric.New("cpu", map[string]string{"host": host}, map[string]interface{}{"idle": 0.5}, now.Add(offset))
+		require.NoError(t, err)
+		return m
+	}
+	a, b := newMetric("a", time.Hour), newMetric("b", time.Hour)
+	if int64(a.HashID()) > int64(b.HashID()) {
+		a, b = b, a
+	}
+	metrics := []telegraf.Metric{b, newMetric("a", 2*time.Minute), a, newMetric("a", time.Minute)}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}, SortRows: true}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 1)
+
+	// The rows start with their hash_id and timestamp.
+	var order []string
+	for _, line := range strings.Split(fd.statements()[0], "\n")[2:] {
+		order = append(order, line[:strings.Index(line, "', ")+1])
+	}
+	key := func(m telegraf.Metric) string {
+		return fmt.Sprintf("(%d, '%s'", int64(m.HashID()), m.Time().Format("2006-01-02T15:04:05-0700"))
+	}
+	require.Equal(t, []string{key(metrics[3]), key(metrics[1]), key(a), key(b)}, order)
+	// The batch of the caller is left as it is.
+	require.Equal(t, b, metrics[0])
+}
+
+func TestWriteStreamChunkSize(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for i := 0; i < 5; i++ {
+		m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}, StreamChunkSize: 2}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 3)
+	for i, want := range []int{2, 2, 1} {
+		require.Equal(t, want, strings.Count(fd.statements()[i], "'cpu'"))
+	}
+}
+
+func TestWriteVerifyRowCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cratedb-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var written int64
+	fd := &fakeDriver{
+		rows: func(query string) int64 { return written },
+	}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	metrics := testutil.MockMetrics()
+
+	require.NoError(t, c.Write(metrics))
+	c.VerifyRowCount = true
+	require.EqualError(t, c.Write(metrics), "CrateDB reported 0 written rows, expected 1")
+	written = 1
+	require.NoError(t, c.Write(metrics))
+
+	// Partially written batches must not be spooled.
+	c.spool, err = newSpool(dir, 0, 0)
+	require.NoError(t, err)
+	written = 0
+	require.Error(t, c.Write(metrics))
+	require.True(t, c.spool.empty())
+}
+
+func TestWriteStats(t *testing.T) {
+	defer useFakeDriver()()
+
+	var down bool
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if down && strings.HasPrefix(query, "INSERT") {
+				return &net.OpError{Op: "write", Net: "tcp", Err: errors.New("connection reset by peer")}
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		URL:     fd.dsn(t),
+		Table:   "stats_table",
+		Timeout: internal.Duration{Duration: time.Second * 5},
+	}
+	// The stats are shared by all outputs writing the table within the
+	// process, so only their changes are compared.
+	require.NoError(t, c.setup())
+	stats := []selfstat.Stat{c.rowsWritten, c.writeErrors, c.writeErrorsByReason["connection"], c.writeErrorsByReason["timeout"], c.connects}
+	before := make([]int64, len(stats))
+	for i, stat := range stats {
+		before[i] = stat.Get()
+	}
+	require.NoError(t, c.Connect())
+	defer c.Close()
+	metrics := append(testutil.MockMetrics(), testutil.MockMetrics()...)
+
+	require.NoError(t, c.Write(metrics))
+	down = true
+	require.Error(t, c.Write(metrics))
+	for i, want := range []int64{2, 1, 1, 0, 1} {
+		require.Equal(t, want, stats[i].Get()-before[i], stats[i].FieldName())
+	}
+}
+
+func TestWriteMissingFieldPolicy(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, fields := range []map[string]interface{}{
+		{"price": 1.5, "qty": 2.5},
+		{"price": 3.5},
+		{"qty": 4.5},
+		{"price": 5.5, "qty": 6.5},
+		{"volume": int64(7)},
+	} {
+		m, err := metric.New("trade", nil, fields, now)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	// Write formats timestamps in the local time zone.
+	ts, err := (&escaper{loc: time.Local}).escape(now)
+	require.NoError(t, err)
+	prefix := `(` + fmt.Sprint(int64(metrics[0].HashID())) + `, ` + ts + `, 'trade', {}, `
+
+	for _, test := range []struct {
+		policy string
+		want   []string
+	}{
+		{
+			policy: "null",
+			want: []string{`INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price", "qty")
+VALUES
+` + prefix + `{}, 1.5, 2.5) ,
+` + prefix + `{}, 3.5, NULL) ,
+` + prefix + `{}, NULL, 4.5) ,
+` + prefix + `{}, 5.5, 6.5) ,
+` + prefix + `{"volume" = 7}, NULL, NULL);`},
+		},
+		{
+			policy: "default",
+			want: []string{`INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price", "qty")
+VALUES
+` + prefix + `{}, 1.5, 2.5) ,
+` + prefix + `{}, 3.5, 0) ,
+` + prefix + `{}, -1, 4.5) ,
+` + prefix + `{}, 5.5, 6.5) ,
+` + prefix + `{"volume" = 7}, -1, 0);`},
+		},
+		{
+			// One statement per set of present columns, in the order of
+			// their first metric.
+			policy: "omit",
+			want: []string{
+				`INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price", "qty")
+VALUES
+` + prefix + `{}, 1.5, 2.5) ,
+` + prefix + `{}, 5.5, 6.5);`,
+				`INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "price")
+VALUES
+` + prefix + `{}, 3.5);`,
+				`INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields", "qty")
+VALUES
+` + prefix + `{}, 4.5);`,
+				`INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+` + prefix + `{"volume" = 7});`,
+			},
+		},
+	} {
+		fd := &fakeDriver{}
+		c := &CrateDB{
+			Table:              "my_table",
+			Timeout:            internal.Duration{Duration: time.Second * 5},
+			DecimalColumns:     []string{"price", "qty"},
+			DecimalPrecision:   10,
+			DecimalScale:       2,
+			MissingFieldPolicy: test.policy,
+		}
+		if test.policy == "default" {
+			c.MissingFieldDefaults = map[string]float64{"price": -1, "qty": 0}
+		}
+		require.NoError(t, c.setup(), test.policy)
+		c.DB = fd.open(t)
+		require.NoError(t, c.Write(metrics), test.policy)
+		require.Equal(t, test.want, fd.statements(), test.policy)
+	}
+
+	c := &CrateDB{
+		Table:                "my_table",
+		DecimalColumns:       []string{"price", "qty"},
+		DecimalPrecision:     10,
+		MissingFieldPolicy:   "default",
+		MissingFieldDefaults: map[string]float64{"price": 0},
+	}
+	require.Error(t, c.setup())
+	c.MissingFieldDefaults["qty"] = 0
+	require.NoError(t, c.setup())
+	c.MissingFieldDefaults["other"] = 0
+	require.Error(t, c.setup())
+	c.MissingFieldPolicy = "zero"
+	require.Error(t, c.setup())
+}
+
+func TestWriteConflictPolicy(t *testing.T) {
+	var execErr error
+	fd := &fakeDriver{
+		exec: func(query string) error { return execErr },
+	}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	duplicate := &pq.Error{Code: "23505", Message: "A document with the same primary key exists already"}
+	execErr = duplicate
+	require.Equal(t, duplicate, c.Write(testutil.MockMetrics()))
+
+	c.ConflictPolicy = "soft"
+	require.NoError(t, c.setup())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	execErr = &pq.Error{Code: "XX000", Message: "DuplicateKeyException: A document with the same primary key exists already"}
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	execErr = &pq.Error{Code: "42P01", Message: "Relation 'my_table' unknown"}
+	require.Error(t, c.Write(testutil.MockMetrics()))
+	execErr = errors.New("connection refused")
+	require.Error(t, c.Write(testutil.MockMetrics()))
+
+	c.ConflictPolicy = "lenient"
+	require.Error(t, c.setup())
+}
+
+func TestWriteMissingTable(t *testing.T) {
+	var exists, creates bool
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if strings.HasPrefix(query, "CREATE TABLE") {
+				exists = creates
+				return nil
+			} else if !exists {
+				return &pq.Error{Code: "42P01", Message: "RelationUnknown: Relation 'doc.my_table' unknown"}
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	// Without table_create, the error is returned as is.
+	require.Error(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, fd.statements(), 1)
+
+	// The table is created again and the batch retried.
+	c.TableCreate = true
+	creates = true
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	stmts := fd.statements()[1:]
+	require.Len(t, stmts, 3)
+	require.True(t, strings.HasPrefix(stmts[0], "INSERT"))
+	require.True(t, strings.HasPrefix(stmts[1], "CREATE TABLE IF NOT EXISTS my_table"))
+	require.Equal(t, stmts[0], stmts[2])
+
+	// If creating the table doesn't help, e.g. because it's created in
+	// another schema, the batch is retried only once.
+	exists, creates = false, false
+	require.Error(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, fd.statements(), 7)
+}
+
+func TestWriteHangingStatement(t *testing.T) {
+	release := make(chan struct{})
+	fd := &fakeDriver{
+		// The fake driver doesn't support contexts, like a driver stuck on
+		// a network read.
+		exec: func(query string) error {
+			<-release
+			return nil
+		},
+	}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: 50 * time.Millisecond}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	start := time.Now()
+	require.EqualError(t, c.Write(testutil.MockMetrics()), "statement did not finish within 50ms")
+	require.True(t, time.Since(start) < time.Second, "write took %s", time.Since(start))
+	require.Equal(t, int64(0), c.writesInFlight.Get())
+
+	close(release)
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Close())
+	for i := 0; i < 100 && fd.openConns() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 0, fd.openConns())
+}
+
+func TestWriteValidateBeforeWrite(t *testing.T) {
+	defer useFakeDriver()()
+
+	var prepares int
+	var invalid bool
+	fd := &fakeDriver{
+		prepare: func(query string) error {
+			if !strings.HasPrefix(query, "INSERT") {
+				return nil
+			}
+			prepares++
+			if invalid {
+				return &pq.Error{Code: "4000", Message: "Column unknown"}
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		Table:               "my_table",
+		Timeout:             internal.Duration{Duration: time.Second * 5},
+		ValidateBeforeWrite: true,
+	}
+	c.URL = fd.dsn(t)
+	require.NoError(t, c.Connect())
+	defer c.Close()
+
+	invalid = true
+	require.EqualError(t, c.Write(testutil.MockMetrics()), "pq: Column unknown")
+	require.Empty(t, fd.statements())
+
+	// The statement is executed once it was validated, and later ones are
+	// executed right away.
+	invalid = false
+	prepares = 0
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, 2, prepares)
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, 3, prepares)
+
+	require.NoError(t, c.reconnect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, 5, prepares)
+	require.Len(t, fd.statements(), 3)
+}
+
+func TestWriteAcquireTimeout(t *testing.T) {
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:          "acquire_table",
+		Timeout:        internal.Duration{Duration: time.Second * 5},
+		AcquireTimeout: internal.Duration{Duration: 50 * time.Millisecond},
+	}
+	require.NoError(t, c.setup())
+	// The stat is shared by all outputs writing the table within the
+	// process, so only its change is compared.
+	timeouts := c.writeErrorsByReason["acquire_timeout"].Get()
+	c.DB = fd.open(t)
+	defer c.DB.Close()
+	c.DB.SetMaxOpenConns(1)
+
+	conn, err := c.DB.Conn(context.Background())
+	require.NoError(t, err)
+	err = c.Write(testutil.MockMetrics())
+	require.EqualError(t, err, "no connection to CrateDB became available within 50ms")
+	require.True(t, isRetryable(err))
+	require.Equal(t, timeouts+1, c.writeErrorsByReason["acquire_timeout"].Get())
+	// A full pool doesn't count towards reconnect_after_errors.
+	require.Equal(t, int64(0), atomic.LoadInt64(&c.errorCount))
+
+	conn.Close()
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, fd.statements(), 1)
+}
+
+func TestMaxConcurrentWrites(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+	}
+	c := &CrateDB{
+		Table:               "my_table",
+		Timeout:             internal.Duration{Duration: 50 * time.Millisecond},
+		MaxConcurrentWrites: 1,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	done := make(chan error)
+	go func() {
+		done <- c.Write(testutil.MockMetrics())
+	}()
+	<-started
+	require.Equal(t, int64(1), c.writesInFlight.Get())
+	require.Len(t, c.writeSlots, 1)
+
+	close(release)
+	require.NoError(t, <-done)
+	require.Equal(t, int64(0), c.writesInFlight.Get())
+	require.Len(t, c.writeSlots, 0)
+
+	// A statement can't outlive the timeout, so the only slot is taken
+	// directly to make the write give up.
+	c.writeSlots <- struct{}{}
+	require.EqualError(t, c.Write(testutil.MockMetrics()), "timeout waiting for one of 1 concurrent writes to finish")
+	<-c.writeSlots
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+}
+
+func TestReconnect(t *testing.T) {
+	defer useFakeDriver()()
+
+	dir, err := ioutil.TempDir("", "cratedb-reconnect")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fd1 := &fakeDriver{}
+	fd2 := &fakeDriver{}
+	c := &CrateDB{
+		URL:         fd1.dsn(t),
+		Table:       "metrics",
+		Timeout:     internal.Duration{Duration: time.Second * 5},
+		TableCreate: true,
+		SpoolDir:    dir,
+	}
+	goroutines := runtime.NumGoroutine()
+
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NotNil(t, c.spool)
+	require.NoError(t, c.Close())
+	require.Equal(t, 0, fd1.openConns())
+
+	// Reload with a different URL and config.
+	c.URL = fd2.dsn(t)
+	c.SpoolDir = ""
+	c.MetadataTagPrefix = "unit_"
+	require.NoError(t, c.Connect())
+	require.Nil(t, c.spool)
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, fd1.statements(), 2)
+	require.Len(t, fd2.statements(), 2)
+	require.Contains(t, fd2.statements()[0], `"metadata" OBJECT(DYNAMIC)`)
+	require.NoError(t, c.Close())
+	require.Equal(t, 0, fd2.openConns())
+	// Closing twice is fine.
+	require.NoError(t, c.Close())
+
+	// database/sql stops its connection opener goroutine asynchronously.
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, runtime.NumGoroutine() <= goroutines, "leaked goroutines")
+}
+
+func TestCloseDuringReconnect(t *testing.T) {
+	defer useFakeDriver()()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:     fd.dsn(t),
+		Table:   "metrics",
+		Timeout: internal.Duration{Duration: time.Second * 5},
+	}
+	require.NoError(t, c.Connect())
+	done := make(chan error)
+	go func() { done <- c.reconnect() }()
+	require.NoError(t, c.Close())
+	require.NoError(t, <-done)
+	// The pool of a reconnect that finished after Close is closed as well.
+	require.NoError(t, c.Close())
+}
+
+func TestReconnectAfterErrors(t *testing.T) {
+	defer useFakeDriver()()
+
+	var down bool
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if down && strings.HasPrefix(query, "INSERT") {
+				return errors.New("connection reset by peer")
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		URL:                  fd.dsn(t),
+		Table:                "reconnect_table",
+		Timeout:              internal.Duration{Duration: time.Second * 5},
+		ReconnectAfterErrors: 2,
+	}
+	require.NoError(t, c.Connect())
+	defer c.Close()
+	first := c.DB
+	connects := c.connects.Get()
+
+	// The errors of another output writing the same table don't count.
+	other := &CrateDB{Table: c.Table}
+	require.NoError(t, other.setup())
+	other.failed()
+
+	down = true
+	require.Error(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, int64(1), atomic.LoadInt64(&c.errorCount))
+	require.True(t, first == c.DB)
+	require.Error(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, int64(0), atomic.LoadInt64(&c.errorCount))
+	require.False(t, first == c.DB)
+	require.Equal(t, connects+1, c.connects.Get())
+
+	// Any success resets the count.
+	require.Error(t, c.Write(testutil.MockMetrics()))
+	down = false
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, int64(0), atomic.LoadInt64(&c.errorCount))
+	require.Equal(t, connects+1, c.connects.Get())
+}
+
+func TestConnectWarmup(t *testing.T) {
+	defer useFakeDriver()()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:               fd.dsn(t),
+		Table:             "metrics",
+		Timeout:           internal.Duration{Duration: time.Second * 5},
+		WarmupConnections: 5,
+	}
+	require.NoError(t, c.Connect())
+	require.Equal(t, 5, fd.openConns())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Equal(t, 5, fd.openConns())
+	require.NoError(t, c.Close())
+	require.Equal(t, 0, fd.openConns())
+}
+
+func Test_cleanup(t *testing.T) {
+	fd := &fakeDriver{}
+	db := fd.open(t)
+	now := time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC)
+
+	c := &CrateDB{Table: "metrics", CleanupOlderThan: internal.Duration{Duration: 24 * time.Hour}}
+	require.NoError(t, c.cleanup(context.Background(), db, now))
+	require.Empty(t, fd.statements())
+
+	c.CleanupOnStart = true
+	require.NoError(t, c.setup())
+	require.NoError(t, c.cleanup(context.Background(), db, now))
+	require.Equal(t, []string{`DELETE FROM metrics WHERE "timestamp" < '2017-08-06T16:44:52+0000'`}, fd.statements())
+
+	require.Error(t, (&CrateDB{CleanupOnStart: true}).setup())
+
+	// The cleanup runs on Connect, but not when reconnecting.
+	defer useFakeDriver()()
+	fd = &fakeDriver{}
+	c = &CrateDB{
+		URL:              fd.dsn(t),
+		Table:            "metrics",
+		Timeout:          internal.Duration{Duration: time.Second * 5},
+		CleanupOnStart:   true,
+		CleanupOlderThan: internal.Duration{Duration: 24 * time.Hour},
+	}
+	require.NoError(t, c.Connect())
+	defer c.Close()
+	require.NoError(t, c.reconnect())
+	var deletes int
+	for _, stmt := range fd.statements() {
+		if strings.HasPrefix(stmt, "DELETE") {
+			deletes++
+		}
+	}
+	require.Equal(t, 1, deletes)
+}
+
+func Test_checkReadiness(t *testing.T) {
 	tests := []struct {
-		Val  interface{}
-		Want string
+		Query  string
+		Expect string
+		Rows   [][]driver.Value
+		Err    error
+		WantOK bool
 	}{
-		// string
-		{`foo`, `'foo'`},
-		{`foo'bar 'yeah`, `'foo''bar ''yeah'`},
-		// int types
-		{123, `123`}, // int
-		{int64(123), `123`},
-		{int32(123), `123`},
-		// float types
-		{123.456, `123.456`},
-		{float32(123.456), `123.456`}, // floating point SNAFU
-		{float64(123.456), `123.456`},
-		// time.Time
-		{time.Date(2017, 8, 7, 16, 44, 52, 123*1000*1000, time.FixedZone("Dreamland", 5400)), `'2017-08-07T16:44:52.123+0130'`},
-		// map[string]string
-		{map[string]string{}, `{}`},
-		{map[string]string(nil), `{}`},
-		{map[string]string{"foo": "bar"}, `{"foo" = 'bar'}`},
-		{map[string]string{"foo": "bar", "one": "more"}, `{"foo" = 'bar', "one" = 'more'}`},
-		// map[string]interface{}
-		{map[string]interface{}{}, `{}`},
-		{map[string]interface{}(nil), `{}`},
-		{map[string]interface{}{"foo": "bar"}, `{"foo" = 'bar'}`},
-		{map[string]interface{}{"foo": "bar", "one": "more"}, `{"foo" = 'bar', "one" = 'more'}`},
-		{map[string]interface{}{"foo": map[string]interface{}{"one": "more"}}, `{"foo" = {"one" = 'more'}}`},
+		{Query: "", WantOK: true},
+		{Query: "SELECT 1", Rows: [][]driver.Value{{int64(1)}}, WantOK: true},
+		{Query: "SELECT 1", Expect: "1", Rows: [][]driver.Value{{int64(1)}}, WantOK: true},
+		{Query: "SELECT 1", Expect: "2", Rows: [][]driver.Value{{int64(1)}}, WantOK: false},
+		{Query: "SELECT 1", Rows: [][]driver.Value{}, WantOK: false},
+		{Query: "SELECT 1", Err: errors.New("permission denied"), WantOK: false},
 	}
 
 	for _, test := range tests {
-		if got, err := escapeValue(test.Val); err != nil {
-			t.Errorf("val: %#v: %s", test.Val, err)
-		} else if got != test.Want {
-			t.Errorf("got:\n%s\n\nwant:\n%s", got, test.Want)
+		fd := &fakeDriver{
+			query: func(query string) ([]string, [][]driver.Value, error) {
+				require.Equal(t, test.Query, query)
+				return []string{"col"}, test.Rows, test.Err
+			},
+		}
+		c := &CrateDB{ReadinessQuery: test.Query, ReadinessExpect: test.Expect}
+		err := c.checkReadiness(context.Background(), fd.open(t))
+		if test.WantOK {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
 		}
 	}
+
+	// setup defaults the query, which disable_readiness_check skips.
+	c := &CrateDB{Table: "metrics"}
+	require.NoError(t, c.setup())
+	require.Equal(t, "SELECT 1", c.ReadinessQuery)
+	c.DisableReadinessCheck = true
+	fd := &fakeDriver{
+		query: func(query string) ([]string, [][]driver.Value, error) {
+			return nil, nil, errors.New("unexpected query: " + query)
+		},
+	}
+	require.NoError(t, c.checkReadiness(context.Background(), fd.open(t)))
+}
+
+func Benchmark_insertSQL(b *testing.B) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	metrics := make([]telegraf.Metric, 1000)
+	for i := range metrics {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{"host": fmt.Sprintf("host%d", i%10), "cpu": fmt.Sprint(i % 8)},
+			map[string]interface{}{"usage_idle": float64(i), "usage_user": int64(i), "state": "ok"},
+			now.Add(time.Duration(i)*time.Second),
+		)
+		require.NoError(b, err)
+		metrics[i] = m
+	}
+
+	for _, style := range []string{"values", "unnest"} {
+		b.Run(style, func(b *testing.B) {
+			c := &CrateDB{Table: "metrics", InsertStyle: style}
+			require.NoError(b, c.setup())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.insertSQL(metrics, time.UTC); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark_writeLargeBatch compares the peak memory estimate of a batch
+// written as a single statement with the one of a batch streamed in chunks.
+func Benchmark_writeLargeBatch(b *testing.B) {
+	defer useFakeDriver()()
+
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	metrics := make([]telegraf.Metric, 100000)
+	for i := range metrics {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{"host": fmt.Sprintf("host%d", i%10), "cpu": fmt.Sprint(i % 8)},
+			map[string]interface{}{"usage_idle": float64(i), "usage_user": int64(i), "state": "ok"},
+			now.Add(time.Duration(i)*time.Millisecond),
+		)
+		require.NoError(b, err)
+		metrics[i] = m
+	}
+
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("stream_chunk_size=%d", size), func(b *testing.B) {
+			fd := &fakeDriver{exec: func(query string) error { return nil }}
+			c := &CrateDB{
+				Table:           fmt.Sprintf("large_batch_%d", size),
+				Timeout:         internal.Duration{Duration: time.Minute},
+				StreamChunkSize: size,
+			}
+			require.NoError(b, c.setup())
+			c.DB = fd.open(b)
+			defer c.DB.Close()
+			c.batchMemoryPeak.Set(0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Write(metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(c.batchMemoryPeak.Get()), "peak-bytes")
+		})
+	}
 }
 
 func testURL() string {
@@ -136,3 +2209,181 @@ func testURL() string {
 	}
 	return url
 }
+
+// fakeDrivers holds the fakeDriver instances by their DSN, see
+// fakeDriver.open.
+var (
+	fakeDriversMu sync.Mutex
+	fakeDrivers   = map[string]*fakeDriver{}
+)
+
+func init() {
+	sql.Register("cratedb_fake", fakeDispatcher{})
+}
+
+// fakeDispatcher dispatches connections to the fakeDriver registered for the
+// given DSN.
+type fakeDispatcher struct{}
+
+func (fakeDispatcher) Open(dsn string) (driver.Conn, error) {
+	fakeDriversMu.Lock()
+	defer fakeDriversMu.Unlock()
+	fd, ok := fakeDrivers[dsn]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake driver: %s", dsn)
+	}
+	fd.mu.Lock()
+	fd.conns++
+	fd.mu.Unlock()
+	return &fakeConn{fd: fd}, nil
+}
+
+// fakeDriver is a database/sql driver for unit tests that records the
+// executed statements and answers them using the optional exec, rows, query
+// and prepare funcs. Every statement is prepared, as the driver doesn't
+// execute statements directly.
+type fakeDriver struct {
+	exec    func(query string) error
+	rows    func(query string) int64
+	query   func(query string) ([]string, [][]driver.Value, error)
+	prepare func(query string) error
+
+	mu    sync.Mutex
+	execs []string
+	args  [][]driver.Value
+	conns int
+}
+
+// dsn registers fd and returns the DSN that can be used to open it with the
+// "cratedb_fake" driver.
+func (fd *fakeDriver) dsn(t testing.TB) string {
+	fakeDriversMu.Lock()
+	defer fakeDriversMu.Unlock()
+	dsn := fmt.Sprintf("%s/%d", t.Name(), len(fakeDrivers))
+	fakeDrivers[dsn] = fd
+	return dsn
+}
+
+// open returns a *sql.DB that is backed by fd.
+func (fd *fakeDriver) open(t testing.TB) *sql.DB {
+	db, err := sql.Open("cratedb_fake", fd.dsn(t))
+	require.NoError(t, err)
+	return db
+}
+
+// openConns returns the number of connections that are currently open.
+func (fd *fakeDriver) openConns() int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.conns
+}
+
+// useFakeDriver makes Connect use the fake driver until the returned func is
+// called.
+func useFakeDriver() func() {
+	driverName = "cratedb_fake"
+	return func() { driverName = "postgres" }
+}
+
+// statements returns the statements executed so far.
+func (fd *fakeDriver) statements() []string {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return append([]string(nil), fd.execs...)
+}
+
+// arguments returns the arguments of the statements executed so far.
+func (fd *fakeDriver) arguments() [][]driver.Value {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return append([][]driver.Value(nil), fd.args...)
+}
+
+type fakeConn struct {
+	fd *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if c.fd.prepare != nil {
+		if err := c.fd.prepare(query); err != nil {
+			return nil, err
+		}
+	}
+	return &fakeStmt{fd: c.fd, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.fd.mu.Lock()
+	c.fd.conns--
+	c.fd.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeStmt struct {
+	fd    *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.fd.mu.Lock()
+	s.fd.execs = append(s.fd.execs, s.query)
+	s.fd.args = append(s.fd.args, args)
+	s.fd.mu.Unlock()
+	if s.fd.exec != nil {
+		if err := s.fd.exec(s.query); err != nil {
+			return nil, err
+		}
+	}
+	if s.fd.rows != nil {
+		return driver.RowsAffected(s.fd.rows(s.query)), nil
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.fd.query == nil && s.query == "SELECT 1" {
+		// The default readiness_query succeeds like with CrateDB.
+		return &fakeRows{cols: []string{"1"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	} else if s.fd.query == nil {
+		return nil, errors.New("unexpected query: " + s.query)
+	}
+	cols, rows, err := s.fd.query(s.query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{cols: cols, rows: rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.cols
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
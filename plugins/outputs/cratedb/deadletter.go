@@ -0,0 +1,66 @@
+package cratedb
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// metricError is returned by insertSQL if a single metric of a batch can't be
+// converted into a row.
+type metricError struct {
+	metric telegraf.Metric
+	err    error
+}
+
+func (e *metricError) Error() string {
+	return e.err.Error()
+}
+
+// deadLetter appends metrics that are dropped because they can't be written
+// to a file, one JSON object per line, e.g.:
+//
+//	{"time":"2017-08-07T16:44:52Z","error":"...","metric":"cpu,host=a idle=0.5 1502124292000000000"}
+//
+// The metric is in line protocol, so it can be reprocessed once the error is
+// fixed.
+type deadLetter struct {
+	path string
+
+	mu sync.Mutex
+}
+
+// deadLetterEntry is a line of the dead letter file.
+type deadLetterEntry struct {
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error"`
+	Metric string    `json:"metric"`
+}
+
+// add appends m with the reason it was dropped.
+func (d *deadLetter) add(m telegraf.Metric, reason error) error {
+	data, err := json.Marshal(deadLetterEntry{
+		Time:   time.Now().UTC(),
+		Error:  reason.Error(),
+		Metric: strings.TrimSuffix(m.String(), "\n"),
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+package cratedb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cratedb-dead-letter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	valid, err := metric.New("trade", map[string]string{}, map[string]interface{}{"price": 0.1}, now)
+	require.NoError(t, err)
+	invalid, err := metric.New("trade", map[string]string{}, map[string]interface{}{"price": "n/a"}, now)
+	require.NoError(t, err)
+	metrics := []telegraf.Metric{invalid, valid, invalid}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:            "my_table",
+		Timeout:          internal.Duration{Duration: time.Second * 5},
+		DecimalColumns:   []string{"price"},
+		DecimalPrecision: 10,
+		DecimalScale:     2,
+		DecimalFallback:  "error",
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.EqualError(t, c.Write(metrics), `trade: field "price" can't be stored as NUMERIC: "n/a"`)
+	require.Empty(t, fd.statements())
+
+	c.DeadLetterFile = filepath.Join(dir, "dead-letter.json")
+	require.NoError(t, c.setup())
+	require.NoError(t, c.Write(metrics))
+	require.Len(t, fd.statements(), 1)
+	require.Contains(t, fd.statements()[0], "0.1);")
+
+	data, err := ioutil.ReadFile(c.DeadLetterFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var entry deadLetterEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, `trade: field "price" can't be stored as NUMERIC: "n/a"`, entry.Error)
+	require.Equal(t, `trade price="n/a" 1257894000000000000`, entry.Metric)
+
+	// Batches without any valid metric aren't written at all.
+	require.NoError(t, c.Write([]telegraf.Metric{invalid}))
+	require.Len(t, fd.statements(), 1)
+	data, err = ioutil.ReadFile(c.DeadLetterFile)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 2)
+}
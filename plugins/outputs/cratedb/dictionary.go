@@ -0,0 +1,208 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+)
+
+// maxNameAttempts limits how often registerNames allocates ids for the same
+// names, which only fails if other agents allocate the same ids meanwhile.
+const maxNameAttempts = 3
+
+// nameDictionary remembers the ids of the metric names that are known to be
+// in the NameDictionary table, so new names are only inserted once.
+type nameDictionary struct {
+	// register serializes registerNames, so concurrent writes don't
+	// allocate the same ids.
+	register sync.Mutex
+
+	mu sync.Mutex
+	// ids maps the known names to their ids.
+	ids map[string]int32
+}
+
+// unknown returns the names of metrics that are not known yet, sorted.
+func (d *nameDictionary) unknown(metrics []telegraf.Metric) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	batch := make(map[string]bool)
+	for _, m := range metrics {
+		if _, ok := d.ids[m.Name()]; !ok {
+			batch[m.Name()] = true
+		}
+	}
+	names := make([]string, 0, len(batch))
+	for name := range batch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// add remembers the ids of names.
+func (d *nameDictionary) add(ids map[string]int32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, id := range ids {
+		d.ids[name] = id
+	}
+}
+
+// id returns the id of name, if it's known.
+func (d *nameDictionary) id(name string) (int32, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id, ok := d.ids[name]
+	return id, ok
+}
+
+// nameColumn returns the column holding the metric name, which is the
+// "name_id" column if NameDictionary is set.
+func (c *CrateDB) nameColumn() column {
+	if c.NameDictionary != "" {
+		return column{Name: "name_id", Type: "INTEGER"}
+	}
+	return column{Name: "name", Type: "STRING"}
+}
+
+// nameValue returns the value of the nameColumn for m. write registers the
+// names of a batch before building its rows, so the id is known.
+func (c *CrateDB) nameValue(m telegraf.Metric) interface{} {
+	if c.NameDictionary != "" {
+		if id, ok := c.names.id(m.Name()); ok {
+			return id
+		}
+		return nil
+	}
+	return m.Name()
+}
+
+// createDictionarySQL returns the CREATE TABLE statement of the
+// NameDictionary table.
+func (c *CrateDB) createDictionarySQL() string {
+	return `CREATE TABLE IF NOT EXISTS ` + c.NameDictionary + ` (` +
+		c.ident("id") + ` INTEGER PRIMARY KEY, ` + c.ident("name") + ` STRING)`
+}
+
+// createDictionaryViewSQL returns the CREATE VIEW statement of the
+// NameDictionaryView, which joins the metrics table with the NameDictionary
+// table to add the "name" column.
+func (c *CrateDB) createDictionaryViewSQL() string {
+	return `CREATE OR REPLACE VIEW ` + c.NameDictionaryView + ` AS SELECT m.*, d.` + c.ident("name") +
+		` FROM ` + c.Table + ` m LEFT JOIN ` + c.NameDictionary + ` d ON m.` + c.ident("name_id") + ` = d.` + c.ident("id")
+}
+
+// registerNames allocates ids for the names of metrics that are not known
+// yet. Names inserted by another agent are looked up first, and new ones get
+// the ids following the largest one in the NameDictionary table. If another
+// agent takes the same ids meanwhile, the remaining names are allocated
+// again. Agents registering the same name at the same time may each insert
+// it with its own id, which the NameDictionaryView resolves to the same name.
+func (c *CrateDB) registerNames(metrics []telegraf.Metric) error {
+	if len(c.names.unknown(metrics)) == 0 {
+		return nil
+	}
+	c.names.register.Lock()
+	defer c.names.register.Unlock()
+
+	// Another write may have registered the names meanwhile.
+	names := c.names.unknown(metrics)
+	for attempt := 0; len(names) > 0; attempt++ {
+		found, err := c.lookupNames(names)
+		if err != nil {
+			return err
+		}
+		c.names.add(found)
+		names = c.names.unknown(metrics)
+		if len(names) == 0 {
+			break
+		} else if attempt == maxNameAttempts {
+			return fmt.Errorf("name_dictionary: allocating an id for %q failed", names[0])
+		}
+		if err := c.insertNames(names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertNames inserts names into the NameDictionary table, with the ids
+// following the largest one in it, and refreshes the table so lookupNames
+// can read them.
+func (c *CrateDB) insertNames(names []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout.Duration)
+	defer cancel()
+	c.dbMu.RLock()
+	db := c.DB
+	c.dbMu.RUnlock()
+	var max sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT max(`+c.ident("id")+`) FROM `+c.NameDictionary).Scan(&max); err != nil {
+		return fmt.Errorf("name_dictionary: reading the largest id failed: %s", err)
+	}
+
+	values := make([]string, len(names))
+	for i, name := range names {
+		escaped, err := escapeValue(name)
+		if err != nil {
+			return err
+		}
+		values[i] = fmt.Sprintf("(%d, %s)", max.Int64+int64(i)+1, escaped)
+	}
+	insert := `INSERT INTO ` + c.NameDictionary + ` (` + c.ident("id") + `, ` + c.ident("name") + `) VALUES ` +
+		strings.Join(values, ", ") + ` ON CONFLICT (` + c.ident("id") + `) DO NOTHING`
+	if err := c.exec(insert); err != nil {
+		return fmt.Errorf("name_dictionary: inserting names failed: %s", err)
+	}
+	if err := c.exec(`REFRESH TABLE ` + c.NameDictionary); err != nil {
+		return fmt.Errorf("name_dictionary: refreshing table failed: %s", err)
+	}
+	return nil
+}
+
+// lookupNames returns the ids of the names that are in the NameDictionary
+// table. A name inserted with several ids gets the smallest one, so all
+// agents use the same id eventually.
+func (c *CrateDB) lookupNames(names []string) (map[string]int32, error) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		escaped, err := escapeValue(name)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = escaped
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout.Duration)
+	defer cancel()
+	c.dbMu.RLock()
+	db := c.DB
+	c.dbMu.RUnlock()
+	rows, err := db.QueryContext(ctx, `SELECT `+c.ident("id")+`, `+c.ident("name")+` FROM `+c.NameDictionary+
+		` WHERE `+c.ident("name")+` IN (`+strings.Join(values, ", ")+`)`)
+	if err != nil {
+		return nil, fmt.Errorf("name_dictionary: reading names failed: %s", err)
+	}
+	defer rows.Close()
+	found := make(map[string]int32, len(names))
+	for rows.Next() {
+		var id int32
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("name_dictionary: reading names failed: %s", err)
+		}
+		if known, ok := found[name]; !ok || id < known {
+			found[name] = id
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("name_dictionary: reading names failed: %s", err)
+	}
+	return found, nil
+}
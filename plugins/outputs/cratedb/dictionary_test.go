@@ -0,0 +1,150 @@
+package cratedb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_insertSQLNameDictionary(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table:              "my_table",
+		DisablePartition:   true,
+		PrimaryKeyName:     true,
+		NameDictionary:     "metric_names",
+		NameDictionaryView: "my_table_named",
+	}
+	require.NoError(t, c.setup())
+	c.names.add(map[string]int32{"cpu": 7})
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name_id", "tags", "fields")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 7, {"host" = 'a'}, {"idle" = 0.5});
+`), got)
+
+	require.Equal(t, []string{
+		c.createSQL(),
+		`CREATE TABLE IF NOT EXISTS metric_names ("id" INTEGER PRIMARY KEY, "name" STRING)`,
+		`CREATE OR REPLACE VIEW my_table_named AS SELECT m.*, d."name" FROM my_table m LEFT JOIN metric_names d ON m."name_id" = d."id"`,
+	}, c.createStatements())
+	require.Contains(t, c.createSQL(), `"name_id" INTEGER,`)
+	require.Contains(t, c.createSQL(), `PRIMARY KEY ("timestamp", "hash_id", "name_id")`)
+
+	c.NameDictionary = ""
+	require.Error(t, c.setup())
+}
+
+func TestWriteNameDictionary(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(name string) telegraf.Metric {
+		m, err := metric.New(name, map[string]string{}, map[string]interface{}{"value": int64(1)}, now)
+		require.NoError(t, err)
+		return m
+	}
+
+	// stored holds the rows of the dictionary table, which may have been
+	// written by another agent. Each INSERT of the plugin is preceded by one
+	// of the steal names, inserted by another agent with the id the plugin
+	// allocated.
+	var mu sync.Mutex
+	stored := map[int64]string{}
+	var steal []string
+	value := regexp.MustCompile(`\((\d+), '([^']*)'\)`)
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if !strings.HasPrefix(query, "INSERT INTO metric_names") {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(steal) > 0 {
+				stored[int64(len(stored)+1)] = steal[0]
+				steal = steal[1:]
+			}
+			for _, match := range value.FindAllStringSubmatch(query, -1) {
+				id, err := strconv.ParseInt(match[1], 10, 64)
+				require.NoError(t, err)
+				if _, ok := stored[id]; !ok {
+					stored[id] = match[2]
+				}
+			}
+			return nil
+		},
+		query: func(query string) ([]string, [][]driver.Value, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.HasPrefix(query, "SELECT max(") {
+				var max driver.Value
+				for id := range stored {
+					if max == nil || id > max.(int64) {
+						max = id
+					}
+				}
+				return []string{"max"}, [][]driver.Value{{max}}, nil
+			}
+			var rows [][]driver.Value
+			for id, name := range stored {
+				if strings.Contains(query, "'"+name+"'") {
+					rows = append(rows, []driver.Value{id, name})
+				}
+			}
+			return []string{"id", "name"}, rows, nil
+		},
+	}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}, NameDictionary: "metric_names"}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("cpu"), newMetric("mem"), newMetric("cpu")}))
+	require.Len(t, fd.statements(), 3)
+	require.Equal(t, `INSERT INTO metric_names ("id", "name") VALUES (1, 'cpu'), (2, 'mem') ON CONFLICT ("id") DO NOTHING`, fd.statements()[0])
+	require.Equal(t, `REFRESH TABLE metric_names`, fd.statements()[1])
+	require.Contains(t, fd.statements()[2], `'2009-11-10T23:00:00+0000', 1, {}`)
+	require.Contains(t, fd.statements()[2], `'2009-11-10T23:00:00+0000', 2, {}`)
+
+	// Known names are not inserted again.
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("mem")}))
+	require.Len(t, fd.statements(), 4)
+
+	// Names inserted by another agent are looked up, using the smallest id of
+	// a name inserted twice.
+	mu.Lock()
+	stored[4], stored[3] = "disk", "disk"
+	mu.Unlock()
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("disk")}))
+	require.Len(t, fd.statements(), 5)
+	require.Contains(t, fd.statements()[4], `'2009-11-10T23:00:00+0000', 3, {}`)
+
+	// Another agent takes the allocated id, so the next one is allocated.
+	mu.Lock()
+	steal = []string{"net"}
+	mu.Unlock()
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("swap")}))
+	require.Len(t, fd.statements(), 10)
+	require.Equal(t, `INSERT INTO metric_names ("id", "name") VALUES (5, 'swap') ON CONFLICT ("id") DO NOTHING`, fd.statements()[5])
+	require.Equal(t, `INSERT INTO metric_names ("id", "name") VALUES (6, 'swap') ON CONFLICT ("id") DO NOTHING`, fd.statements()[7])
+	require.Contains(t, fd.statements()[9], `'2009-11-10T23:00:00+0000', 6, {}`)
+
+	// The write fails if the ids keep being taken, and is retried later.
+	mu.Lock()
+	steal = []string{"net", "net", "net"}
+	mu.Unlock()
+	require.EqualError(t, c.Write([]telegraf.Metric{newMetric("load")}), `name_dictionary: allocating an id for "load" failed`)
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("load")}))
+}
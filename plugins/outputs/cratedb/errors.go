@@ -0,0 +1,104 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// errorReasons are the reasons returned by errorReason. Each of them has a
+// "write_errors_<reason>" internal stat.
+var errorReasons = []string{"connection", "timeout", "acquire_timeout", "type", "duplicate_key", "oversized", "other"}
+
+// timeoutError is returned if a statement or write did not finish in time.
+type timeoutError string
+
+func (e timeoutError) Error() string {
+	return string(e)
+}
+
+// acquireTimeoutError is returned if no connection of the pool became
+// available within AcquireTimeout.
+type acquireTimeoutError string
+
+func (e acquireTimeoutError) Error() string {
+	return string(e)
+}
+
+// errorReason classifies an error returned by write, so the failed writes
+// can be counted by reason:
+//
+//   - "connection" for network errors and broken connections,
+//   - "timeout" for statements or writes that did not finish within timeout,
+//   - "acquire_timeout" for statements that got no connection of the pool
+//     within acquire_timeout,
+//   - "type" for values that can't be converted into a row or that CrateDB
+//     can't store in their column,
+//   - "duplicate_key" for rows with an existing primary key,
+//   - "oversized" for statements CrateDB rejects because of their size,
+//   - "other" for all other errors, e.g. other errors reported by CrateDB.
+func errorReason(err error) string {
+	switch t := err.(type) {
+	case timeoutError:
+		return "timeout"
+	case acquireTimeoutError:
+		return "acquire_timeout"
+	case *metricError:
+		return "type"
+	case *pq.Error:
+		switch {
+		case isDuplicateKey(t):
+			return "duplicate_key"
+		case isOversized(t):
+			return "oversized"
+		case isTypeError(t):
+			return "type"
+		}
+		return "other"
+	case net.Error:
+		if t.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return "timeout"
+	case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF:
+		return "connection"
+	}
+	return "other"
+}
+
+// isTypeError returns true if CrateDB rejected a value because it doesn't
+// match the type of its column. CrateDB doesn't use the data exception codes
+// consistently, so the message is checked as well.
+func isTypeError(err *pq.Error) bool {
+	if err.Code.Class() == "22" || err.Code == "42804" {
+		return true
+	}
+	for _, s := range []string{"Cannot cast", "ColumnValidationException", "MapperParsingException"} {
+		if strings.Contains(err.Message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOversized returns true if CrateDB rejected a statement because of its
+// size, e.g. because building its rows would trip a circuit breaker.
+func isOversized(err *pq.Error) bool {
+	if err.Code.Class() == "54" {
+		return true
+	}
+	for _, s := range []string{"CircuitBreakingException", "too large", "max_content_length"} {
+		if strings.Contains(err.Message, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_errorReason(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		reason string
+	}{
+		{timeoutError("statement did not finish within 5s"), "timeout"},
+		{context.DeadlineExceeded, "timeout"},
+		{acquireTimeoutError("no connection to CrateDB became available within 1s"), "acquire_timeout"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "connection"},
+		{driver.ErrBadConn, "connection"},
+		{io.ErrUnexpectedEOF, "connection"},
+		{&metricError{err: errors.New(`field "price" can't be stored as NUMERIC`)}, "type"},
+		{&pq.Error{Code: "23505", Message: "A document with the same primary key exists already"}, "duplicate_key"},
+		{&pq.Error{Code: "XX000", Message: "DuplicateKeyException: A document with the same primary key exists already"}, "duplicate_key"},
+		{&pq.Error{Code: "22P02", Message: "invalid input syntax"}, "type"},
+		{&pq.Error{Code: "XX000", Message: "Cannot cast value `abc` to type `bigint`"}, "type"},
+		{&pq.Error{Code: "XX000", Message: "CircuitBreakingException: [query] Data too large"}, "oversized"},
+		{&pq.Error{Code: "42601", Message: "SQLParseException: line 1:1: mismatched input"}, "other"},
+		{&rowCountError{got: 1, want: 2}, "other"},
+		{fmt.Errorf("cpu: metric has no timestamp"), "other"},
+	} {
+		require.Equal(t, test.reason, errorReason(test.err), "%v", test.err)
+		require.Contains(t, errorReasons, test.reason)
+	}
+}
@@ -0,0 +1,257 @@
+package cratedb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// escaper converts values into SQL literals according to the configuration
+// of the plugin.
+type escaper struct {
+	// loc is the location timestamps are converted to before they're
+	// formatted. If nil, timestamps keep their location.
+	loc *time.Location
+	// controlChars enables escaping of backslashes and control characters in
+	// string values using escape string literals, see escapeControlChars.
+	controlChars bool
+	// unquotedKeys leaves the keys of objects unquoted if they are simple
+	// identifiers, see isSimpleIdentifier.
+	unquotedKeys bool
+	// timeFormat is the format of timestamps, see timestampFormat.
+	timeFormat string
+	// utf8 sanitizes invalid UTF-8 in strings and keys if set.
+	utf8 *utf8Sanitizer
+}
+
+// checkTimestampFormat returns an error if format is neither "iso8601",
+// "epoch_millis" nor a Go time layout whose output can be parsed again.
+func checkTimestampFormat(format string) error {
+	switch format {
+	case "", "iso8601", "epoch_millis":
+		return nil
+	}
+	ref := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	formatted := ref.Format(format)
+	if formatted == format {
+		return fmt.Errorf("timestamp_format: %q is not a time layout", format)
+	} else if _, err := time.Parse(format, formatted); err != nil {
+		return fmt.Errorf("timestamp_format: %q is not a valid time layout: %s", format, err)
+	}
+	return nil
+}
+
+// escapeValue is like escaper.escape using the default configuration.
+func escapeValue(val interface{}) (string, error) {
+	return (&escaper{}).escape(val)
+}
+
+// escape returns a string version of val that is suitable for being used
+// inside of a VALUES expression or similar. Unsupported types return an error.
+//
+// Warning: This is not ideal from a security perspective, but unfortunately
+// older CrateDB versions do not support enough of the PostgreSQL wire
+// protocol to allow using lib/pq with $1, $2 placeholders. Security conscious
+// users of this plugin should use insert_style = "unnest_bind" with newer
+// versions, or refrain from using it in combination with untrusted inputs.
+func (e *escaper) escape(val interface{}) (string, error) {
+	switch t := val.(type) {
+	case nil:
+		return "NULL", nil
+	case decimal:
+		return string(t), nil
+	case double:
+		return t.String(), nil
+	case bitString:
+		return "B'" + string(t) + "'", nil
+	case string:
+		if e.utf8 != nil {
+			t = e.utf8.sanitize(t)
+		}
+		if e.controlChars && strings.IndexFunc(t, needsEscape) >= 0 {
+			return escapeControlChars(t), nil
+		}
+		return escapeString(t, `'`), nil
+	// We don't handle uint, uint32 and uint64 here because CrateDB doesn't
+	// seem to support unsigned types. But it seems like input plugins don't
+	// produce those types, so it's hopefully ok.
+	case int, int32, int64, float32, float64:
+		return fmt.Sprint(t), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case time.Time:
+		// Timestamps are formatted the same way no matter if they're the
+		// timestamp of the metric or a (nested) field value.
+		return e.escape(e.formatTime(t))
+	case map[string]string:
+		return e.escapeObject(convertMap(t))
+	case map[string]interface{}:
+		return e.escapeObject(t)
+	case []interface{}:
+		elems := make([]string, 0, len(t))
+		for _, v := range t {
+			elem, err := e.escape(v)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, elem)
+		}
+		return "[" + strings.Join(elems, ", ") + "]", nil
+	default:
+		// This might be panic worthy under normal circumstances, but it's probably
+		// better to not shut down the entire telegraf process because of one
+		// misbehaving plugin.
+		return "", fmt.Errorf("unexpected type: %T: %#v", t, t)
+	}
+}
+
+// formatTime returns t as a string according to the configured location and
+// timeFormat, or as milliseconds since the epoch for "epoch_millis".
+func (e *escaper) formatTime(t time.Time) interface{} {
+	if e.loc != nil {
+		t = t.In(e.loc)
+	}
+	switch e.timeFormat {
+	case "", "iso8601":
+		// see https://crate.io/docs/crate/reference/sql/data_types.html#timestamp
+		return t.Format("2006-01-02T15:04:05.999-0700")
+	case "epoch_millis":
+		return t.UnixNano() / int64(time.Millisecond)
+	default:
+		return t.Format(e.timeFormat)
+	}
+}
+
+// convertMap converts m from map[string]string to map[string]interface{} by
+// copying it. Generics, oh generics where art thou?
+func convertMap(m map[string]string) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (e *escaper) escapeObject(m map[string]interface{}) (string, error) {
+	// There is a decent chance that the implementation below doesn't catch all
+	// edge cases, but it's hard to tell since the format seems to be a bit
+	// underspecified.
+	// See https://crate.io/docs/crate/reference/sql/data_types.html#object
+
+	// We find all keys and sort them first because iterating a map in go is
+	// randomized and we need consistent output for our unit tests.
+	keys := make([]string, 0, len(m))
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Now we build our key = val pairs
+	pairs := make([]string, 0, len(m))
+	for _, k := range keys {
+		// escape the value of our key k (potentially recursive)
+		val, err := e.escape(m[k])
+		if err != nil {
+			return "", err
+		}
+		key := k
+		if e.utf8 != nil {
+			key = e.utf8.sanitize(key)
+		}
+		if !e.unquotedKeys || !isSimpleIdentifier(key) {
+			key = escapeString(key, `"`)
+		}
+		pairs = append(pairs, key+" = "+val)
+	}
+	return `{` + strings.Join(pairs, ", ") + `}`, nil
+}
+
+// reservedKeywords are the keywords CrateDB doesn't accept as unquoted
+// identifiers.
+// See https://crate.io/docs/crate/reference/en/latest/sql/general/lexical-structure.html#key-words-and-identifiers
+var reservedKeywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`
+		add all alter and any array as asc between by called case cast column
+		constraint costs create cross current_date current_schema current_time
+		current_timestamp current_user default delete deny desc describe
+		directory distinct drop else end escape except exists extract false
+		first for from full function grant group having if in index inner input
+		insert intersect into is join last left like limit match natural not
+		null nulls object offset on or order outer persistent recursive reset
+		returns revoke right select session_user set some stratify table then
+		transient true try_cast unbounded union update user using when where
+		with`) {
+		reservedKeywords[k] = true
+	}
+}
+
+// isSimpleIdentifier returns true if s can be used as an identifier without
+// quoting it, i.e. it's lowercase, consists of letters, digits and
+// underscores only, and is not a reserved keyword.
+func isSimpleIdentifier(s string) bool {
+	if s == "" || reservedKeywords[s] {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// escapeString wraps s in the given quote string and replaces all occurences
+// of it inside of s with a double quote.
+func escapeString(s string, quote string) string {
+	return quote + strings.Replace(s, quote, quote+quote, -1) + quote
+}
+
+// needsEscape returns true for the runes escapeControlChars escapes.
+func needsEscape(r rune) bool {
+	return r == '\\' || unicode.IsControl(r)
+}
+
+// escapeControlChars returns s as an escape string literal, e.g. E'a\tb',
+// with backslashes, quotes and control characters escaped. In a regular
+// string literal these are stored as is, which is correct for CrateDB, but
+// may confuse middleware or tools that parse the statements.
+// See https://crate.io/docs/crate/reference/en/latest/general/ddl/data-types.html#character-data
+func escapeControlChars(s string) string {
+	var buf bytes.Buffer
+	buf.WriteString("E'")
+	for _, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\'':
+			buf.WriteString(`\'`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if unicode.IsControl(r) {
+				fmt.Fprintf(&buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteString("'")
+	return buf.String()
+}
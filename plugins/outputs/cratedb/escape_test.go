@@ -0,0 +1,159 @@
+package cratedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_escapeValue(t *testing.T) {
+	tests := []struct {
+		Val  interface{}
+		Want string
+	}{
+		// nil
+		{nil, `NULL`},
+		// decimal
+		{decimal("1.25"), `1.25`},
+		// string
+		{`foo`, `'foo'`},
+		{`foo'bar 'yeah`, `'foo''bar ''yeah'`},
+		// int types
+		{123, `123`}, // int
+		{int64(123), `123`},
+		{int32(123), `123`},
+		// float types
+		{123.456, `123.456`},
+		{float32(123.456), `123.456`}, // floating point SNAFU
+		{float64(123.456), `123.456`},
+		// bool
+		{true, `true`},
+		{false, `false`},
+		// time.Time
+		{time.Date(2017, 8, 7, 16, 44, 52, 123*1000*1000, time.FixedZone("Dreamland", 5400)), `'2017-08-07T16:44:52.123+0130'`},
+		// map[string]string
+		{map[string]string{}, `{}`},
+		{map[string]string(nil), `{}`},
+		{map[string]string{"foo": "bar"}, `{"foo" = 'bar'}`},
+		{map[string]string{"foo": "bar", "one": "more"}, `{"foo" = 'bar', "one" = 'more'}`},
+		// map[string]interface{}
+		{map[string]interface{}{}, `{}`},
+		{map[string]interface{}(nil), `{}`},
+		{map[string]interface{}{"foo": "bar"}, `{"foo" = 'bar'}`},
+		{map[string]interface{}{"foo": "bar", "one": "more"}, `{"foo" = 'bar', "one" = 'more'}`},
+		{map[string]interface{}{"foo": map[string]interface{}{"one": "more"}}, `{"foo" = {"one" = 'more'}}`},
+	}
+
+	for _, test := range tests {
+		if got, err := escapeValue(test.Val); err != nil {
+			t.Errorf("val: %#v: %s", test.Val, err)
+		} else if got != test.Want {
+			t.Errorf("got:\n%s\n\nwant:\n%s", got, test.Want)
+		}
+	}
+}
+
+func Test_escaperTime(t *testing.T) {
+	ts := time.Date(2017, 8, 7, 16, 44, 52, 123456789, time.FixedZone("Dreamland", 5400))
+	e := &escaper{loc: time.UTC}
+
+	timestamp, err := e.escape(ts)
+	require.NoError(t, err)
+	require.Equal(t, `'2017-08-07T15:14:52.123+0000'`, timestamp)
+
+	// time.Time field values, including nested ones, are formatted exactly
+	// like the timestamp of the metric.
+	fields, err := e.escape(map[string]interface{}{
+		"start":  ts,
+		"nested": map[string]interface{}{"end": ts},
+	})
+	require.NoError(t, err)
+	require.Equal(t, `{"nested" = {"end" = `+timestamp+`}, "start" = `+timestamp+`}`, fields)
+
+	// Without a location the timestamp keeps its own.
+	local, err := escapeValue(ts)
+	require.NoError(t, err)
+	require.Equal(t, `'2017-08-07T16:44:52.123+0130'`, local)
+}
+
+func Test_escaperTimestampFormat(t *testing.T) {
+	ts := time.Date(2017, 8, 7, 16, 44, 52, 123456789, time.FixedZone("Dreamland", 5400))
+	for _, test := range []struct {
+		format string
+		want   string
+	}{
+		{"", `'2017-08-07T15:14:52.123+0000'`},
+		{"iso8601", `'2017-08-07T15:14:52.123+0000'`},
+		{"epoch_millis", `1502118892123`},
+		{"2006-01-02 15:04:05.000Z07:00", `'2017-08-07 15:14:52.123Z'`},
+	} {
+		require.NoError(t, checkTimestampFormat(test.format))
+		got, err := (&escaper{loc: time.UTC, timeFormat: test.format}).escape(ts)
+		require.NoError(t, err)
+		require.Equal(t, test.want, got, test.format)
+	}
+
+	for _, format := range []string{"epoch_seconds", "unix"} {
+		require.Error(t, checkTimestampFormat(format), format)
+	}
+}
+
+func Test_escaperControlChars(t *testing.T) {
+	tests := []struct {
+		Val   string
+		Plain string
+		Want  string
+	}{
+		{`foo`, `'foo'`, `'foo'`},
+		{`it's`, `'it''s'`, `'it''s'`},
+		{`C:\temp`, `'C:\temp'`, `E'C:\\temp'`},
+		{`it's C:\`, `'it''s C:\'`, `E'it\'s C:\\'`},
+		{"a\tb", "'a\tb'", `E'a\tb'`},
+		{"a\nb\r\n", "'a\nb\r\n'", `E'a\nb\r\n'`},
+		{"\b\f", "'\b\f'", `E'\b\f'`},
+		{"bell\a\x00", "'bell\a\x00'", `E'bell\u0007\u0000'`},
+		{"Grüße 🚀", "'Grüße 🚀'", "'Grüße 🚀'"},
+		{"日本語\t✓", "'日本語\t✓'", `E'日本語\t✓'`},
+	}
+
+	plain := &escaper{}
+	e := &escaper{controlChars: true}
+	for _, test := range tests {
+		got, err := plain.escape(test.Val)
+		require.NoError(t, err)
+		require.Equal(t, test.Plain, got, "val: %q", test.Val)
+
+		got, err = e.escape(test.Val)
+		require.NoError(t, err)
+		require.Equal(t, test.Want, got, "val: %q", test.Val)
+	}
+
+	got, err := e.escape(map[string]interface{}{"path": `C:\temp`, "tags": map[string]string{"line": "a\nb"}})
+	require.NoError(t, err)
+	require.Equal(t, `{"path" = E'C:\\temp', "tags" = {"line" = E'a\nb'}}`, got)
+}
+
+func Test_isSimpleIdentifier(t *testing.T) {
+	for ident, want := range map[string]bool{
+		"metrics":     true,
+		"hash_id":     true,
+		"_private":    true,
+		"cpu2":        true,
+		"":            false,
+		"2cpu":        false,
+		"Metrics":     false,
+		"usage-idle":  false,
+		"doc.metrics": false,
+		"größe":       false,
+		"select":      false,
+		"index":       false,
+	} {
+		require.Equal(t, want, isSimpleIdentifier(ident), ident)
+	}
+
+	e := &escaper{unquotedKeys: true}
+	got, err := e.escape(map[string]interface{}{"host": "a", "Host": "b", "order": map[string]string{"id": "1"}})
+	require.NoError(t, err)
+	require.Equal(t, `{"Host" = 'b', host = 'a', "order" = {id = '1'}}`, got)
+}
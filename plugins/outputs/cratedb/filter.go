@@ -0,0 +1,131 @@
+package cratedb
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// writeFilter is a compiled write_filter expression of the form
+// "field op literal", e.g. `temperature > 80` or `status != "ok"`.
+type writeFilter struct {
+	field string
+	op    string
+	// value is the literal, a float64, string or bool.
+	value interface{}
+}
+
+// writeFilterRe splits a write_filter expression into field, operator and
+// literal. The field is either a bare key or a double quoted one.
+var writeFilterRe = regexp.MustCompile(`^\s*("(?:[^"\\]|\\.)*"|[^\s=!<>"]+)\s*(==|!=|>=|<=|>|<)\s*(.+?)\s*$`)
+
+// compileWriteFilter parses a write_filter expression.
+func compileWriteFilter(expr string) (*writeFilter, error) {
+	match := writeFilterRe.FindStringSubmatch(expr)
+	if match == nil {
+		return nil, fmt.Errorf("write_filter: expected \"field op literal\": %q", expr)
+	}
+	f := &writeFilter{field: match[1], op: match[2]}
+	if strings.HasPrefix(f.field, `"`) {
+		field, err := strconv.Unquote(f.field)
+		if err != nil {
+			return nil, fmt.Errorf("write_filter: invalid field %s: %s", f.field, err)
+		}
+		f.field = field
+	}
+
+	literal := match[3]
+	switch {
+	case strings.HasPrefix(literal, `"`):
+		s, err := strconv.Unquote(literal)
+		if err != nil {
+			return nil, fmt.Errorf("write_filter: invalid string %s: %s", literal, err)
+		}
+		f.value = s
+	case literal == "true" || literal == "false":
+		if f.op != "==" && f.op != "!=" {
+			return nil, fmt.Errorf("write_filter: booleans can only be compared with == and !=: %q", expr)
+		}
+		f.value = literal == "true"
+	default:
+		v, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, fmt.Errorf("write_filter: invalid literal %s: expected a number, string or boolean", literal)
+		}
+		f.value = v
+	}
+	return f, nil
+}
+
+// match returns true if the field of m compares to the literal according to
+// the operator. Metrics without the field, or with a value of a different
+// type than the literal, don't match.
+func (f *writeFilter) match(m telegraf.Metric) bool {
+	v, ok := m.Fields()[f.field]
+	if !ok {
+		return false
+	}
+
+	var cmp int
+	switch lit := f.value.(type) {
+	case float64:
+		var n float64
+		switch t := v.(type) {
+		case int64:
+			n = float64(t)
+		case float64:
+			n = t
+		default:
+			return false
+		}
+		switch {
+		case n < lit:
+			cmp = -1
+		case n > lit:
+			cmp = 1
+		}
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(s, lit)
+	case bool:
+		b, ok := v.(bool)
+		if !ok {
+			return false
+		}
+		if b != lit {
+			cmp = 1
+		}
+	}
+
+	switch f.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
+
+// filter returns the metrics matching f.
+func (f *writeFilter) filter(metrics []telegraf.Metric) []telegraf.Metric {
+	kept := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if f.match(m) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,69 @@
+package cratedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeFilter(t *testing.T) {
+	m, err := metric.New(
+		"sensor",
+		map[string]string{"host": "a"},
+		map[string]interface{}{"temperature": 81.5, "count": int64(3), "status": "ok", "up": true, "odd key": int64(1)},
+		time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC),
+	)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		expr  string
+		match bool
+	}{
+		{"temperature > 80", true},
+		{"temperature>=81.5", true},
+		{"temperature < 80", false},
+		{"count == 3", true},
+		{"count != 3", false},
+		{"count <= 2", false},
+		{`status == "ok"`, true},
+		{`status != "ok"`, false},
+		{"up == true", true},
+		{"up != true", false},
+		{`"odd key" == 1`, true},
+		// Missing fields and values of another type never match.
+		{"missing != 1", false},
+		{`temperature != "hot"`, false},
+		{"status > 1", false},
+	} {
+		f, err := compileWriteFilter(test.expr)
+		require.NoError(t, err, test.expr)
+		require.Equal(t, test.match, f.match(m), test.expr)
+	}
+
+	for _, expr := range []string{"", "temperature", "temperature > ", "temperature ~ 1", "temperature > hot", `status == "ok`, "up > true"} {
+		_, err := compileWriteFilter(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestWriteFilter(t *testing.T) {
+	now := time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC)
+	var metrics []telegraf.Metric
+	for _, temperature := range []float64{75, 85, 95} {
+		m, err := metric.New("sensor", nil, map[string]interface{}{"temperature": temperature}, now)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	c := &CrateDB{WriteFilter: "temperature > 80"}
+	require.NoError(t, c.setup())
+	kept, err := c.prepare(metrics)
+	require.NoError(t, err)
+	require.Equal(t, metrics[1:], kept)
+
+	c.WriteFilter = "temperature >"
+	require.Error(t, c.setup())
+}
@@ -0,0 +1,205 @@
+package cratedb
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// KeyRewrite is a rule of the key_rewrite option that replaces the matches of
+// Pattern in tag and field keys with Replacement, which can refer to
+// submatches like regexp.Regexp.ReplaceAllString.
+type KeyRewrite struct {
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+}
+
+// keyRewrite is a compiled KeyRewrite.
+type keyRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// compileKeyRewrites compiles the key_rewrite rules.
+func compileKeyRewrites(rules []KeyRewrite) ([]keyRewrite, error) {
+	compiled := make([]keyRewrite, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("key_rewrite: %s", err)
+		}
+		compiled = append(compiled, keyRewrite{re: re, replacement: rule.Replacement})
+	}
+	return compiled, nil
+}
+
+// rewriteKey applies all rules to key, in order.
+func (c *CrateDB) rewriteKey(key string) string {
+	for _, r := range c.keyRewrites {
+		key = r.re.ReplaceAllString(key, r.replacement)
+	}
+	return key
+}
+
+// limitKey returns key shortened to MaxKeyLength bytes, or an empty key if
+// it's longer and KeyLengthPolicy is "skip".
+func (c *CrateDB) limitKey(key string) string {
+	if c.MaxKeyLength <= 0 || len(key) <= c.MaxKeyLength {
+		return key
+	} else if c.KeyLengthPolicy == "skip" {
+		return ""
+	}
+	return truncateUTF8(key, c.MaxKeyLength)
+}
+
+// truncateUTF8 returns the longest prefix of s with at most n bytes that
+// doesn't end within a multi-byte character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// newKey returns the key stored for key, with the rules and MaxKeyLength
+// applied.
+func (c *CrateDB) newKey(key string) string {
+	return c.limitKey(c.rewriteKey(key))
+}
+
+// keyCollisionError is returned for metrics with keys that end up the same
+// after key_rewrite or MaxKeyLength if KeyCollisionPolicy is "error".
+type keyCollisionError struct {
+	name, what string
+	key, other string
+	renamedTo  string
+}
+
+func (e *keyCollisionError) Error() string {
+	return fmt.Sprintf("%s: %s %q is renamed to %q like %q", e.name, e.what, e.key, e.renamedTo, e.other)
+}
+
+// rewriteKeys returns the new key for each of the given keys, leaving out
+// keys that are dropped because of a collision. Keys that are not changed by
+// the rules or MaxKeyLength are handled first, followed by the other keys in
+// sorted order, so the result doesn't depend on the order of keys. A key
+// colliding with an earlier one is dropped with KeyCollisionPolicy "first",
+// replaces it with "last", gets a numeric suffix with "suffix", and fails
+// the metric with "error". what and name are used to log collisions.
+func (c *CrateDB) rewriteKeys(keys []string, what, name string) (map[string]string, error) {
+	sort.Strings(keys)
+	renamed := make(map[string]string, len(keys))
+	taken := make(map[string]string, len(keys))
+	var changed []string
+	for _, k := range keys {
+		if nk := c.newKey(k); nk != k {
+			changed = append(changed, k)
+			continue
+		}
+		renamed[k] = k
+		taken[k] = k
+	}
+	for _, k := range changed {
+		rk := c.rewriteKey(k)
+		nk := c.limitKey(rk)
+		// Keys that are too long likely come from a misbehaving input, so
+		// they are logged as warnings.
+		level := "D!"
+		if nk != rk {
+			level = "W!"
+			if nk != "" {
+				log.Printf("W! CrateDB: %s: %s %q is longer than %d bytes, truncating it to %q", name, what, k, c.MaxKeyLength, nk)
+			}
+		}
+		if other, ok := taken[nk]; ok {
+			switch c.KeyCollisionPolicy {
+			case "last":
+				log.Printf("%s CrateDB: %s: dropping %s %q, %q is renamed to %q like it", level, name, what, other, k, nk)
+				delete(renamed, other)
+			case "suffix":
+				sk := c.suffixKey(nk, taken)
+				log.Printf("%s CrateDB: %s: renaming %s %q to %q, %q is renamed to %q already", level, name, what, k, sk, other, nk)
+				nk = sk
+			case "error":
+				return nil, &keyCollisionError{name: name, what: what, key: k, other: other, renamedTo: nk}
+			default:
+				log.Printf("%s CrateDB: %s: dropping %s %q, it's renamed to %q like %q", level, name, what, k, nk, other)
+				continue
+			}
+		} else if nk == "" && rk != "" {
+			log.Printf("W! CrateDB: %s: dropping %s %q, it's longer than %d bytes", name, what, k, c.MaxKeyLength)
+			continue
+		} else if nk == "" {
+			log.Printf("D! CrateDB: %s: dropping %s %q, it's renamed to an empty key", name, what, k)
+			continue
+		}
+		renamed[k] = nk
+		taken[nk] = k
+	}
+	return renamed, nil
+}
+
+// suffixKey returns key with the lowest numeric suffix, starting at "_2",
+// that isn't taken, shortening key if the result would be longer than
+// MaxKeyLength. setup ensures that MaxKeyLength fits the names of the fixed
+// columns, so there's room for the suffix.
+func (c *CrateDB) suffixKey(key string, taken map[string]string) string {
+	for i := 2; ; i++ {
+		suffix := "_" + strconv.Itoa(i)
+		base := key
+		if c.MaxKeyLength > 0 {
+			base = truncateUTF8(base, c.MaxKeyLength-len(suffix))
+		}
+		if _, ok := taken[base+suffix]; !ok {
+			return base + suffix
+		}
+	}
+}
+
+// rewriteTags returns tags with the key_rewrite rules and MaxKeyLength
+// applied to their keys.
+func (c *CrateDB) rewriteTags(name string, tags map[string]string) (map[string]string, error) {
+	if len(c.keyRewrites) == 0 && c.MaxKeyLength <= 0 {
+		return tags, nil
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	renamed, err := c.rewriteKeys(keys, "tag", name)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(tags))
+	for k, nk := range renamed {
+		result[nk] = tags[k]
+	}
+	return result, nil
+}
+
+// rewriteFields returns fields with the key_rewrite rules and MaxKeyLength
+// applied to their keys.
+func (c *CrateDB) rewriteFields(name string, fields map[string]interface{}) (map[string]interface{}, error) {
+	if len(c.keyRewrites) == 0 && c.MaxKeyLength <= 0 {
+		return fields, nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	renamed, err := c.rewriteKeys(keys, "field", name)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(fields))
+	for k, nk := range renamed {
+		result[nk] = fields[k]
+	}
+	return result, nil
+}
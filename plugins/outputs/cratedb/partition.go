@@ -0,0 +1,69 @@
+package cratedb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+)
+
+// partitionTagError is returned for metrics that can't be written with
+// PartitionTag, because they lack the tag or have a value that would exceed
+// PartitionTagMaxValues. Such metrics are skipped.
+type partitionTagError struct {
+	name   string
+	reason string
+}
+
+func (e *partitionTagError) Error() string {
+	return fmt.Sprintf("%s: %s", e.name, e.reason)
+}
+
+// partitionValues holds the values of PartitionTag written by this process,
+// to limit the number of partitions to PartitionTagMaxValues.
+type partitionValues struct {
+	mu     sync.Mutex
+	values map[string]bool
+}
+
+// add adds val, unless max values are known already. max of 0 means no
+// limit.
+func (p *partitionValues) add(val string, max int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.values[val] {
+		return true
+	} else if max > 0 && len(p.values) >= max {
+		return false
+	}
+	if p.values == nil {
+		p.values = make(map[string]bool)
+	}
+	p.values[val] = true
+	return true
+}
+
+// partitionTagColumn returns the STRING column of PartitionTag, which is part
+// of the primary key and partitions the table. The tag is removed from the
+// "tags" object. Metrics without the tag get PartitionTagDefault, or are
+// skipped if it's not set, as primary key columns can't be NULL.
+func (c *CrateDB) partitionTagColumn() column {
+	return column{
+		Name: c.PartitionTag,
+		Type: "STRING",
+		Value: func(m telegraf.Metric, tags map[string]string, fields map[string]interface{}) (interface{}, error) {
+			val, ok := tags[c.PartitionTag]
+			delete(tags, c.PartitionTag)
+			if !ok || val == "" {
+				if c.PartitionTagDefault == "" {
+					return nil, &partitionTagError{name: m.Name(), reason: fmt.Sprintf("missing partition_tag %q", c.PartitionTag)}
+				}
+				val = c.PartitionTagDefault
+			}
+			if !c.partitionValues.add(val, c.PartitionTagMaxValues) {
+				return nil, &partitionTagError{name: m.Name(), reason: fmt.Sprintf("value %q of partition_tag %q exceeds partition_tag_max_values of %d", val, c.PartitionTag, c.PartitionTagMaxValues)}
+			}
+			return val, nil
+		},
+	}
+}
@@ -0,0 +1,65 @@
+package cratedb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePartitionTag(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(tags map[string]string) telegraf.Metric {
+		m, err := metric.New("cpu", tags, map[string]interface{}{"idle": 0.5}, now)
+		require.NoError(t, err)
+		return m
+	}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:                 "my_table",
+		Timeout:               internal.Duration{Duration: time.Second * 5},
+		PartitionTag:          "region",
+		PartitionTagMaxValues: 2,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	create := c.createSQL()
+	require.Contains(t, create, "\n\t\"region\" STRING,")
+	require.Contains(t, create, `PRIMARY KEY ("timestamp", "hash_id", "day", "region")`)
+	require.True(t, strings.HasSuffix(create, `) PARTITIONED BY ("day", "region");`), create)
+
+	require.NoError(t, c.Write([]telegraf.Metric{
+		newMetric(map[string]string{"region": "eu", "host": "a"}),
+		newMetric(map[string]string{"host": "a"}),
+		newMetric(map[string]string{"region": "us"}),
+		newMetric(map[string]string{"region": "ap"}),
+		newMetric(map[string]string{"region": "eu"}),
+	}))
+	stmts := fd.statements()
+	require.Len(t, stmts, 1)
+	require.Contains(t, stmts[0], `"fields", "region")`)
+	require.Contains(t, stmts[0], `{"host" = 'a'}, {"idle" = 0.5}, 'eu')`)
+	require.Contains(t, stmts[0], `{}, {"idle" = 0.5}, 'us')`)
+	require.NotContains(t, stmts[0], `'ap'`)
+	require.Equal(t, 3, strings.Count(stmts[0], "'cpu'"))
+
+	// Without partitions by day, the tag is the only partition column.
+	c.DisablePartition = true
+	c.PartitionTagDefault = "unknown"
+	require.NoError(t, c.setup())
+	create = c.createSQL()
+	require.Contains(t, create, `PRIMARY KEY ("timestamp", "hash_id", "region")`)
+	require.True(t, strings.HasSuffix(create, `) PARTITIONED BY ("region");`), create)
+	got, err := c.insertSQL([]telegraf.Metric{newMetric(map[string]string{})}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `'unknown');`)
+
+	c.PartitionTagMaxValues = -1
+	require.Error(t, c.setup())
+}
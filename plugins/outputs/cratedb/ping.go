@@ -0,0 +1,66 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pingSQL is the statement that checks the pool for PingInterval.
+const pingSQL = "SELECT 1"
+
+// pinger checks the connection pool every PingInterval between writes, and
+// reconnects if the check fails, so an outage is noticed and recovered from
+// before the next write needs the pool.
+type pinger struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// start pings the pool returned by db every interval until stop is called.
+func (p *pinger) start(interval time.Duration, c *CrateDB, db func() *sql.DB) {
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				if db := db(); db != nil {
+					c.ping(db)
+				}
+			}
+		}
+	}()
+}
+
+// stop stops pinging, if start was called.
+func (p *pinger) stop() {
+	if p.done == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	p.done = nil
+}
+
+// ping runs pingSQL on db within Timeout, and reconnects if it fails, unless
+// a failed write is reconnecting already.
+func (c *CrateDB) ping(db *sql.DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout.Duration)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, pingSQL); err != nil {
+		if _, err := c.tryReconnect(fmt.Sprintf("ping failed, reconnecting: %s", err)); err != nil {
+			log.Printf("E! CrateDB: reconnecting failed: %s", err)
+		}
+		return
+	}
+	c.lastPing.Set(time.Now().Unix())
+}
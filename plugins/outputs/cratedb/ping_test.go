@@ -0,0 +1,66 @@
+package cratedb
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectPingInterval(t *testing.T) {
+	defer useFakeDriver()()
+
+	var (
+		mu    sync.Mutex
+		pings int
+	)
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if query != pingSQL {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			pings++
+			if pings == 1 {
+				return errors.New("connection reset by peer")
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		URL:          fd.dsn(t),
+		Table:        "ping_table",
+		Timeout:      internal.Duration{Duration: time.Second * 5},
+		PingInterval: internal.Duration{Duration: 10 * time.Millisecond},
+	}
+	require.NoError(t, c.Connect())
+	connects := c.connects.Get()
+
+	// The failed ping reconnects, and the next ones succeed. Pings run one at
+	// a time, so the second one has finished once the third one is sent.
+	executed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return pings
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for executed() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, executed() >= 3)
+	require.True(t, c.lastPing.Get() > 0)
+	require.Equal(t, connects+1, c.connects.Get())
+	require.NoError(t, c.Close())
+
+	// No pings are sent after Close.
+	n := executed()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, n, executed())
+
+	c.PingInterval = internal.Duration{Duration: -time.Second}
+	require.Error(t, c.setup())
+}
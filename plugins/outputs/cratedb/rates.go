@@ -0,0 +1,163 @@
+package cratedb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// counters remembers the last written value of the RateFields of each series,
+// so the per second rate of a counter can be stored next to its value. It
+// holds at most maxSize series and evicts the least recently written ones
+// beyond that.
+type counters struct {
+	fields  []string
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// rates holds the rates of the metrics of the batches being written.
+	rates map[telegraf.Metric]map[string]float64
+}
+
+// counter is the value of a counters entry.
+type counter struct {
+	series string
+	values map[string]float64
+	time   time.Time
+}
+
+// newCounters returns an empty counters for fields holding at most maxSize
+// series.
+func newCounters(fields []string, maxSize int) *counters {
+	return &counters{
+		fields:  fields,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		rates:   make(map[telegraf.Metric]map[string]float64),
+	}
+}
+
+// compute computes the rates of metrics from the last written value of their
+// series or an earlier metric of the same series in the batch, which are
+// looked up by rate until release is called. A field gets no rate if there's
+// no earlier value, or if the value decreased, i.e. the counter was reset.
+// compute doesn't remember the values, which is up to update once the
+// metrics have been written.
+func (c *counters) compute(metrics []telegraf.Metric) (release func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch := make(map[string]*counter)
+	for _, m := range metrics {
+		series := seriesID(m)
+		last, ok := batch[series]
+		if !ok {
+			if e, ok := c.entries[series]; ok {
+				last = e.Value.(*counter)
+			}
+		}
+		cur := c.counter(series, m)
+		if len(cur.values) == 0 {
+			continue
+		}
+		if last != nil && cur.time.After(last.time) {
+			seconds := cur.time.Sub(last.time).Seconds()
+			rates := make(map[string]float64)
+			for field, v := range cur.values {
+				if prev, ok := last.values[field]; ok && v >= prev {
+					rates[field] = (v - prev) / seconds
+				}
+			}
+			c.rates[m] = rates
+		}
+		if last == nil || cur.time.After(last.time) {
+			batch[series] = cur
+		}
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, m := range metrics {
+			delete(c.rates, m)
+		}
+	}
+}
+
+// rate returns the rate of field of m, or nil if it has none.
+func (c *counters) rate(m telegraf.Metric, field string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.rates[m][field]; ok {
+		return double(r)
+	}
+	return nil
+}
+
+// update remembers the values of written metrics, unless a later value of
+// their series is known already.
+func (c *counters) update(metrics []telegraf.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range metrics {
+		series := seriesID(m)
+		v := c.counter(series, m)
+		if len(v.values) == 0 {
+			continue
+		}
+		if e, ok := c.entries[series]; ok {
+			if v.time.After(e.Value.(*counter).time) {
+				e.Value = v
+			}
+			c.lru.MoveToFront(e)
+			continue
+		}
+		c.entries[series] = c.lru.PushFront(v)
+		for c.lru.Len() > c.maxSize {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*counter).series)
+		}
+	}
+}
+
+// counter returns the numeric values of the fields of m.
+func (c *counters) counter(series string, m telegraf.Metric) *counter {
+	fields := m.Fields()
+	values := make(map[string]float64, len(c.fields))
+	for _, field := range c.fields {
+		switch v := fields[field].(type) {
+		case int64:
+			values[field] = float64(v)
+		case uint64:
+			values[field] = float64(v)
+		case float64:
+			values[field] = v
+		}
+	}
+	return &counter{series: series, values: values, time: m.Time()}
+}
+
+// len returns the number of series held.
+func (c *counters) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// rateColumn returns a DOUBLE column holding the per second rate of the
+// counter field computed by counters.
+func (c *CrateDB) rateColumn(field string) column {
+	return column{
+		Name: field + "_rate",
+		Type: "DOUBLE",
+		Value: func(m telegraf.Metric, tags map[string]string, fields map[string]interface{}) (interface{}, error) {
+			return c.counters.rate(m, field), nil
+		},
+	}
+}
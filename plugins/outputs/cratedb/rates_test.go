@@ -0,0 +1,70 @@
+package cratedb
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+// rateRe matches the value of the last column of a row.
+var rateRe = regexp.MustCompile(`, ([0-9.]+|NULL)\)`)
+
+func TestWriteRateFields(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(host string, offset time.Duration, bytes int64) telegraf.Metric {
+		m, err := metric.New("net", map[string]string{"host": host}, map[string]interface{}{"bytes_recv": bytes}, now.Add(offset))
+		require.NoError(t, err)
+		return m
+	}
+	rates := func(stmt string) []string {
+		var values []string
+		for _, match := range rateRe.FindAllStringSubmatch(stmt, -1) {
+			values = append(values, match[1])
+		}
+		return values
+	}
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		Table:         "my_table",
+		Timeout:       internal.Duration{Duration: time.Second * 5},
+		RateFields:    []string{"bytes_recv"},
+		RateCacheSize: 1,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	require.Contains(t, c.createSQL(), "\"bytes_recv_rate\" DOUBLE")
+
+	// The first metric of a series has no rate, later ones of the batch
+	// use the previous one.
+	require.NoError(t, c.Write([]telegraf.Metric{
+		newMetric("a", 0, 100),
+		newMetric("a", 10*time.Second, 150),
+	}))
+	// Rates continue from the last written batch, and a reset gets none.
+	require.NoError(t, c.Write([]telegraf.Metric{
+		newMetric("a", 20*time.Second, 250),
+		newMetric("a", 30*time.Second, 50),
+		newMetric("a", 40*time.Second, 60),
+	}))
+	stmts := fd.statements()
+	require.Len(t, stmts, 2)
+	require.Equal(t, []string{"NULL", "5.0"}, rates(stmts[0]))
+	require.Equal(t, []string{"10.0", "NULL", "1.0"}, rates(stmts[1]))
+	require.Contains(t, stmts[1], `{"bytes_recv" = 250}`)
+
+	// Only rate_cache_size series are kept.
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("b", 0, 1)}))
+	require.Equal(t, 1, c.counters.len())
+	require.NoError(t, c.Write([]telegraf.Metric{newMetric("a", 50*time.Second, 70)}))
+	require.Equal(t, []string{"NULL"}, rates(fd.statements()[3]))
+	require.Len(t, c.counters.rates, 0)
+
+	c.RateCacheSize = 0
+	require.Error(t, c.setup())
+}
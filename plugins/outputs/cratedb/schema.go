@@ -0,0 +1,457 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// schema returns all columns of the metrics table, starting with the fixed
+// ones.
+func (c *CrateDB) schema() []column {
+	cols := c.baseSchema()
+	for i := range cols {
+		cols[i].Type = c.indexType(cols[i].Name, cols[i].Type)
+	}
+	return cols
+}
+
+// baseSchema returns the columns of the metrics table without applying
+// IndexOffColumns and IndexColumns.
+func (c *CrateDB) baseSchema() []column {
+	cols := []column{
+		{Name: "hash_id", Type: hashIDColumnType(c.HashIDType, c.HashIDEncoding)},
+		{Name: "timestamp", Type: "TIMESTAMP"},
+		c.nameColumn(),
+		{Name: "tags", Type: objectType(c.TagsStorage)},
+		{Name: "fields", Type: c.fieldsType()},
+	}
+	if c.fieldsExtra() {
+		cols = append(cols, column{Name: "fields_extra", Type: "OBJECT(DYNAMIC)"})
+	}
+	if c.fieldsOverflow() {
+		cols = append(cols, column{Name: "fields_overflow", Type: "STRING"})
+	}
+	if !c.DisablePartition {
+		cols = append(cols, column{Name: "day", Type: `TIMESTAMP GENERATED ALWAYS AS date_trunc('day', ` + c.ident("timestamp") + `)`})
+	}
+	cols = append(cols, c.columns...)
+	if c.ChecksumColumn != "" {
+		cols = append(cols, column{Name: c.ChecksumColumn, Type: checksumType(c.ChecksumAlgorithm)})
+	}
+	return cols
+}
+
+// indexType returns the type of a column according to IndexOffColumns and
+// IndexColumns.
+func (c *CrateDB) indexType(name, typ string) string {
+	if contains(c.IndexColumns, name) {
+		return strings.TrimSuffix(typ, " INDEX OFF")
+	} else if !contains(c.IndexOffColumns, name) || strings.HasSuffix(typ, " INDEX OFF") {
+		return typ
+	}
+	if strings.HasPrefix(typ, "OBJECT(DYNAMIC)") {
+		return "OBJECT(IGNORED)" + strings.TrimPrefix(typ, "OBJECT(DYNAMIC)")
+	}
+	return typ + " INDEX OFF"
+}
+
+// checkIndexColumns validates IndexOffColumns and IndexColumns.
+func (c *CrateDB) checkIndexColumns() error {
+	types := make(map[string]string)
+	for _, col := range c.baseSchema() {
+		types[col.Name] = col.Type
+	}
+	for _, name := range c.IndexOffColumns {
+		typ, ok := types[name]
+		if !ok {
+			return fmt.Errorf("index_off_columns: unknown column: %q", name)
+		} else if contains(c.IndexColumns, name) {
+			return fmt.Errorf("index_off_columns: column %q is part of index_columns as well", name)
+		} else if strings.Contains(typ, " GENERATED ") {
+			return fmt.Errorf("index_off_columns: generated column %q can't be created with INDEX OFF", name)
+		} else if normalizeType(typ) == "object" && !strings.HasPrefix(typ, "OBJECT(DYNAMIC)") {
+			return fmt.Errorf("index_off_columns: column %q is not a dynamic object", name)
+		}
+	}
+	for _, name := range c.IndexColumns {
+		if _, ok := types[name]; !ok {
+			return fmt.Errorf("index_columns: unknown column: %q", name)
+		}
+	}
+	return nil
+}
+
+// storageSettingRe matches a single setting of a STORAGE WITH clause, e.g.
+// "columnstore = false".
+var storageSettingRe = regexp.MustCompile(`^\s*[a-z_][a-z0-9_.]*\s*=\s*(true|false|-?[0-9]+(\.[0-9]+)?|'[^']*')\s*$`)
+
+// checkColumnStorage validates ColumnStorage.
+func (c *CrateDB) checkColumnStorage() error {
+	types := make(map[string]bool)
+	for _, col := range c.schema() {
+		types[col.Name] = true
+	}
+	for name, settings := range c.ColumnStorage {
+		if !types[name] {
+			return fmt.Errorf("column_storage: unknown column: %q", name)
+		}
+		for _, setting := range strings.Split(settings, ",") {
+			if !storageSettingRe.MatchString(setting) {
+				return fmt.Errorf("column_storage: invalid setting for column %q: %q", name, strings.TrimSpace(setting))
+			}
+		}
+	}
+	return nil
+}
+
+// contains returns true if names contains name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldsType returns the type of the "fields" column, which is a strict
+// object if FieldObjectSchema is set.
+func (c *CrateDB) fieldsType() string {
+	if len(c.FieldObjectSchema) == 0 {
+		return objectType(c.FieldsStorage)
+	}
+	names := make([]string, 0, len(c.FieldObjectSchema))
+	for name := range c.FieldObjectSchema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defs := make([]string, 0, len(names))
+	for _, name := range names {
+		defs = append(defs, c.ident(name)+" "+strings.TrimSpace(c.FieldObjectSchema[name]))
+	}
+	return "OBJECT(STRICT) AS (" + strings.Join(defs, ", ") + ")"
+}
+
+// hashIDColumnType returns the type of the "hash_id" column according to the
+// hash_id_type and hash_id_encoding options.
+func hashIDColumnType(hashIDType, encoding string) string {
+	if hashIDType == "string" || encoding == "hex" {
+		return "STRING INDEX OFF"
+	}
+	return "LONG INDEX OFF"
+}
+
+// primaryKey returns the names of the primary key columns of the metrics
+// table. The partition columns have to be part of it.
+func (c *CrateDB) primaryKey() []string {
+	pk := []string{"timestamp", "hash_id"}
+	if c.HashMode == "document" {
+		// A document is replaced by the latest metric of its entity.
+		pk = []string{"hash_id"}
+	}
+	if c.PrimaryKeyName {
+		pk = append(pk, c.nameColumn().Name)
+	}
+	if !c.DisablePartition {
+		pk = append(pk, "day")
+	}
+	if c.PartitionTag != "" {
+		pk = append(pk, c.PartitionTag)
+	}
+	return pk
+}
+
+// createStatements returns the statements run by table_create: createSQL,
+// followed by the statements creating the name dictionary and its view.
+func (c *CrateDB) createStatements() []string {
+	stmts := []string{c.createSQL()}
+	if c.NameDictionary != "" {
+		stmts = append(stmts, c.createDictionarySQL())
+	}
+	if c.NameDictionaryView != "" {
+		stmts = append(stmts, c.createDictionaryViewSQL())
+	}
+	return stmts
+}
+
+// createSQL returns the CREATE TABLE statement used by table_create.
+func (c *CrateDB) createSQL() string {
+	return c.createTableSQL(c.Table)
+}
+
+// createTableSQL returns the CREATE TABLE statement of a metrics table with
+// the given name.
+func (c *CrateDB) createTableSQL(table string) string {
+	var defs []string
+	for _, col := range c.schema() {
+		def := c.ident(col.Name) + " " + col.Type
+		if settings, ok := c.ColumnStorage[col.Name]; ok {
+			def += " STORAGE WITH (" + strings.TrimSpace(settings) + ")"
+		}
+		defs = append(defs, def)
+	}
+	for _, name := range c.FulltextColumns {
+		defs = append(defs, fmt.Sprintf(
+			"INDEX %s USING FULLTEXT (%s) WITH (analyzer = %s)",
+			c.ident(fulltextIndexName(name)),
+			c.ident(name),
+			escapeString(c.FulltextAnalyzer, `'`),
+		))
+	}
+	var pk []string
+	for _, name := range c.primaryKey() {
+		pk = append(pk, c.ident(name))
+	}
+	defs = append(defs, "PRIMARY KEY ("+strings.Join(pk, ", ")+")")
+	var partitionedBy []string
+	if !c.DisablePartition {
+		partitionedBy = append(partitionedBy, c.ident("day"))
+	}
+	if c.PartitionTag != "" {
+		partitionedBy = append(partitionedBy, c.ident(c.PartitionTag))
+	}
+	partitioned := ""
+	if len(partitionedBy) > 0 {
+		partitioned = ` PARTITIONED BY (` + strings.Join(partitionedBy, ", ") + `)`
+	}
+	with := ""
+	if len(c.LongColumnSuffixes) > 0 {
+		// The LONG columns are added by the INSERT statements.
+		with = ` WITH (column_policy = 'dynamic')`
+	}
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+	` + strings.Join(defs, ",\n\t") + `
+)` + partitioned + with + `;`
+}
+
+// ident returns name as an identifier, which is quoted unless
+// UnquotedIdentifiers is set and name is a simple identifier.
+func (c *CrateDB) ident(name string) string {
+	if c.UnquotedIdentifiers && isSimpleIdentifier(name) {
+		return name
+	}
+	return escapeString(name, `"`)
+}
+
+// fulltextIndexName returns the name of the fulltext index of a column.
+func fulltextIndexName(column string) string {
+	return column + "_ft"
+}
+
+// typeAliases maps the type names used in DDL statements and the ones
+// reported by different CrateDB versions in information_schema.columns to a
+// common name.
+var typeAliases = map[string]string{
+	"long":                        "bigint",
+	"int8":                        "bigint",
+	"integer":                     "integer",
+	"int":                         "integer",
+	"int4":                        "integer",
+	"short":                       "smallint",
+	"int2":                        "smallint",
+	"byte":                        "char",
+	"string":                      "text",
+	"varchar":                     "text",
+	"character varying":           "text",
+	"double":                      "double precision",
+	"float8":                      "double precision",
+	"float":                       "real",
+	"float4":                      "real",
+	"boolean":                     "boolean",
+	"bool":                        "boolean",
+	"timestamp":                   "timestamp with time zone",
+	"timestamptz":                 "timestamp with time zone",
+	"timestamp without time zone": "timestamp without time zone",
+	"decimal":                     "numeric",
+	"object_array":                "array",
+}
+
+// subcolumnTypes are the normalized types allowed in field_object_schema.
+var subcolumnTypes = map[string]bool{
+	"boolean":                     true,
+	"char":                        true,
+	"smallint":                    true,
+	"integer":                     true,
+	"bigint":                      true,
+	"real":                        true,
+	"double precision":            true,
+	"numeric":                     true,
+	"text":                        true,
+	"ip":                          true,
+	"timestamp with time zone":    true,
+	"timestamp without time zone": true,
+	"geo_point":                   true,
+	"geo_shape":                   true,
+}
+
+// subcolumnTypeRe matches a type name with optional parameters, e.g.
+// NUMERIC(18, 4), without anything else following it.
+var subcolumnTypeRe = regexp.MustCompile(`^([A-Za-z_]+(?: [A-Za-z_]+)*)\s*(?:\(\s*\d+\s*(?:,\s*\d+\s*)?\))?$`)
+
+// isSubcolumnType returns true if t is a valid CrateDB type for a subcolumn
+// declared in field_object_schema.
+func isSubcolumnType(t string) bool {
+	match := subcolumnTypeRe.FindStringSubmatch(strings.TrimSpace(t))
+	if match == nil {
+		return false
+	}
+	// The name alone has to be a type, so constraints like INDEX OFF are
+	// rejected.
+	name := strings.ToLower(match[1])
+	if alias, ok := typeAliases[name]; ok {
+		name = alias
+	}
+	return subcolumnTypes[name]
+}
+
+// multiWordTypes are the types whose names contain spaces.
+var multiWordTypes = []string{
+	"double precision",
+	"character varying",
+	"timestamp with time zone",
+	"timestamp without time zone",
+}
+
+// normalizeType returns the base type of t, e.g. "bigint" for
+// "LONG INDEX OFF", normalized via typeAliases.
+func normalizeType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	// Strip type parameters, e.g. OBJECT(DYNAMIC) or NUMERIC(18, 4), as well
+	// as everything following them.
+	if i := strings.Index(t, "("); i >= 0 {
+		t = t[:i]
+	}
+
+	base := ""
+	for _, multi := range multiWordTypes {
+		if strings.HasPrefix(t, multi) {
+			base = multi
+			break
+		}
+	}
+	if base == "" {
+		// Strip constraints and generated column expressions.
+		if words := strings.Fields(t); len(words) > 0 {
+			base = words[0]
+		}
+	}
+	if alias, ok := typeAliases[base]; ok {
+		return alias
+	}
+	return base
+}
+
+// castType returns the type of a column definition without its constraints,
+// e.g. "LONG" for "LONG INDEX OFF", so it can be used in a CAST expression.
+// Type parameters like the precision of NUMERIC(18, 4) are kept.
+func castType(def string) string {
+	def = strings.TrimSpace(def)
+	lower := strings.ToLower(def)
+
+	base := ""
+	for _, multi := range multiWordTypes {
+		if strings.HasPrefix(lower, multi) {
+			base = def[:len(multi)]
+			break
+		}
+	}
+	if base == "" {
+		base = def
+		if i := strings.IndexAny(def, " \t\n("); i >= 0 {
+			base = def[:i]
+		}
+	}
+	if rest := def[len(base):]; strings.HasPrefix(rest, "(") {
+		if i := strings.Index(rest, ")"); i >= 0 {
+			base += rest[:i+1]
+		}
+	}
+	return base
+}
+
+// schemaDiff compares the expected columns against the actual column types
+// and returns a description of each difference. Additional columns in the
+// actual schema are not considered a difference.
+func schemaDiff(expected []column, actual map[string]string) []string {
+	var diff []string
+	for _, col := range expected {
+		got, ok := actual[col.Name]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("missing column %q", col.Name))
+		} else if want := normalizeType(col.Type); normalizeType(got) != want {
+			diff = append(diff, fmt.Sprintf("column %q has type %s, expected %s", col.Name, got, want))
+		}
+	}
+	return diff
+}
+
+// checkSchema compares the schema of the existing metrics table against the
+// one expected by the plugin according to SchemaCheck.
+func (c *CrateDB) checkSchema(ctx context.Context, db *sql.DB) error {
+	return c.checkTableSchema(ctx, db, "", c.Table)
+}
+
+// checkTableSchema is like checkSchema for the table in schema, or for table
+// as configured if schema is empty.
+func (c *CrateDB) checkTableSchema(ctx context.Context, db *sql.DB, schema, table string) error {
+	if c.SchemaCheck == "" || c.SchemaCheck == "off" {
+		return nil
+	}
+
+	schemaCond := "table_schema = CURRENT_SCHEMA"
+	args := []interface{}{table}
+	if schema != "" {
+		schemaCond = "table_schema = $2"
+		args = []interface{}{table, schema}
+		table = schema + "." + table
+	} else if i := strings.Index(table, "."); i >= 0 {
+		schemaCond = "table_schema = $2"
+		args = []interface{}{table[i+1:], table[:i]}
+	}
+	rows, err := db.QueryContext(ctx,
+		"SELECT column_name, data_type FROM information_schema.columns "+
+			"WHERE table_name = $1 AND "+schemaCond,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("schema check for table %q failed: %s", table, err)
+	}
+	defer rows.Close()
+
+	actual := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return fmt.Errorf("schema check for table %q failed: %s", table, err)
+		}
+		// Skip the sub columns of objects, e.g. tags['host'].
+		if !strings.Contains(name, "[") {
+			actual[name] = typ
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("schema check for table %q failed: %s", table, err)
+	}
+
+	var diff []string
+	if len(actual) == 0 {
+		diff = []string{"table does not exist"}
+	} else {
+		diff = schemaDiff(c.schema(), actual)
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("table %q does not match the expected schema: %s", table, strings.Join(diff, "; "))
+	if c.SchemaCheck == "strict" {
+		return fmt.Errorf("%s", msg)
+	}
+	log.Printf("W! CrateDB: %s", msg)
+	return nil
+}
@@ -0,0 +1,265 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_normalizeType(t *testing.T) {
+	tests := []struct {
+		Type string
+		Want string
+	}{
+		{"LONG INDEX OFF", "bigint"},
+		{"bigint", "bigint"},
+		{"TIMESTAMP", "timestamp with time zone"},
+		{"timestamp with time zone", "timestamp with time zone"},
+		{`TIMESTAMP GENERATED ALWAYS AS date_trunc('day', "timestamp")`, "timestamp with time zone"},
+		{"STRING", "text"},
+		{"text", "text"},
+		{"OBJECT(DYNAMIC)", "object"},
+		{"object", "object"},
+		{"NUMERIC(18, 4)", "numeric"},
+		{"DOUBLE", "double precision"},
+		{"double precision", "double precision"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.Want, normalizeType(test.Type), "type: %s", test.Type)
+	}
+}
+
+func Test_castType(t *testing.T) {
+	tests := []struct {
+		Def  string
+		Want string
+	}{
+		{"LONG INDEX OFF", "LONG"},
+		{"STRING", "STRING"},
+		{"INTEGER", "INTEGER"},
+		{"DOUBLE PRECISION", "DOUBLE PRECISION"},
+		{"NUMERIC(18, 4)", "NUMERIC(18, 4)"},
+		{"OBJECT(DYNAMIC)", "OBJECT(DYNAMIC)"},
+		{"timestamp with time zone", "timestamp with time zone"},
+		{`TIMESTAMP GENERATED ALWAYS AS date_trunc('day', "timestamp")`, "TIMESTAMP"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.Want, castType(test.Def), "def: %s", test.Def)
+	}
+}
+
+func Test_schemaDiff(t *testing.T) {
+	c := &CrateDB{}
+	require.NoError(t, c.setup())
+
+	actual := map[string]string{
+		"hash_id":   "bigint",
+		"timestamp": "timestamp with time zone",
+		"name":      "text",
+		"tags":      "object",
+		"fields":    "object",
+		"day":       "timestamp with time zone",
+		"extra":     "text",
+	}
+	require.Empty(t, schemaDiff(c.schema(), actual))
+
+	actual["hash_id"] = "text"
+	delete(actual, "fields")
+	require.Equal(t, []string{
+		`column "hash_id" has type text, expected bigint`,
+		`missing column "fields"`,
+	}, schemaDiff(c.schema(), actual))
+}
+
+func Test_checkSchema(t *testing.T) {
+	columns := [][]driver.Value{
+		{"hash_id", "text"},
+		{"timestamp", "timestamp with time zone"},
+		{"name", "text"},
+		{"tags", "object"},
+		{"tags['host']", "text"},
+		{"fields", "object"},
+		{"day", "timestamp with time zone"},
+	}
+	fd := &fakeDriver{
+		query: func(query string) ([]string, [][]driver.Value, error) {
+			return []string{"column_name", "data_type"}, append([][]driver.Value(nil), columns...), nil
+		},
+	}
+	db := fd.open(t)
+
+	require.NoError(t, (&CrateDB{Table: "metrics", SchemaCheck: "off"}).checkSchema(context.Background(), db))
+	require.NoError(t, (&CrateDB{Table: "metrics", SchemaCheck: "warn"}).checkSchema(context.Background(), db))
+	err := (&CrateDB{Table: "doc.metrics", SchemaCheck: "strict"}).checkSchema(context.Background(), db)
+	require.EqualError(t, err, `table "doc.metrics" does not match the expected schema: column "hash_id" has type text, expected bigint`)
+
+	columns = nil
+	err = (&CrateDB{Table: "metrics", SchemaCheck: "strict"}).checkSchema(context.Background(), db)
+	require.EqualError(t, err, `table "metrics" does not match the expected schema: table does not exist`)
+}
+
+func Test_createSQL(t *testing.T) {
+	c := &CrateDB{
+		Table:            "metrics",
+		FulltextColumns:  []string{"name"},
+		FulltextAnalyzer: "english",
+	}
+	require.NoError(t, c.setup())
+	require.Equal(t, `CREATE TABLE IF NOT EXISTS metrics (
+	"hash_id" LONG INDEX OFF,
+	"timestamp" TIMESTAMP,
+	"name" STRING,
+	"tags" OBJECT(DYNAMIC),
+	"fields" OBJECT(DYNAMIC),
+	"day" TIMESTAMP GENERATED ALWAYS AS date_trunc('day', "timestamp"),
+	INDEX "name_ft" USING FULLTEXT ("name") WITH (analyzer = 'english'),
+	PRIMARY KEY ("timestamp", "hash_id", "day")
+) PARTITIONED BY ("day");`, c.createSQL())
+
+	require.Error(t, (&CrateDB{FulltextColumns: []string{"name"}}).setup())
+	require.Error(t, (&CrateDB{FulltextColumns: []string{"missing"}, FulltextAnalyzer: "standard"}).setup())
+	require.Error(t, (&CrateDB{FulltextColumns: []string{"tags"}, FulltextAnalyzer: "standard"}).setup())
+	require.Error(t, (&CrateDB{
+		FulltextColumns:  []string{"name"},
+		FulltextAnalyzer: "standard",
+		DecimalColumns:   []string{"name_ft"},
+		DecimalPrecision: 10,
+	}).setup())
+}
+
+func Test_createSQLPrimaryKeyName(t *testing.T) {
+	c := &CrateDB{Table: "metrics"}
+	require.NoError(t, c.setup())
+	require.Contains(t, c.createSQL(), `PRIMARY KEY ("timestamp", "hash_id", "day")`)
+
+	c.PrimaryKeyName = true
+	require.NoError(t, c.setup())
+	require.Contains(t, c.createSQL(), `PRIMARY KEY ("timestamp", "hash_id", "name", "day")`)
+}
+
+func Test_createSQLUnpartitioned(t *testing.T) {
+	c := &CrateDB{Table: "metrics", DisablePartition: true}
+	require.NoError(t, c.setup())
+	require.Equal(t, `CREATE TABLE IF NOT EXISTS metrics (
+	"hash_id" LONG INDEX OFF,
+	"timestamp" TIMESTAMP,
+	"name" STRING,
+	"tags" OBJECT(DYNAMIC),
+	"fields" OBJECT(DYNAMIC),
+	PRIMARY KEY ("timestamp", "hash_id")
+);`, c.createSQL())
+
+	c.PrimaryKeyName = true
+	c.LongColumnSuffixes = []string{"_count"}
+	require.NoError(t, c.setup())
+	require.True(t, strings.HasSuffix(c.createSQL(), `PRIMARY KEY ("timestamp", "hash_id", "name")
+) WITH (column_policy = 'dynamic');`))
+
+	// Without a "day" column, it can be used by promoted columns.
+	c.DecimalColumns = []string{"day"}
+	c.DecimalPrecision = 10
+	require.NoError(t, c.setup())
+	require.Contains(t, c.createSQL(), `"day" NUMERIC(10, 0)`)
+}
+
+func Test_createSQLFieldObjectSchema(t *testing.T) {
+	c := &CrateDB{
+		Table:              "metrics",
+		DisablePartition:   true,
+		FieldObjectSchema:  map[string]string{"usage_idle": "DOUBLE", "status": "STRING", "price": "NUMERIC(18, 4)"},
+		FieldObjectUnknown: "extra",
+	}
+	require.NoError(t, c.setup())
+	require.Equal(t, `CREATE TABLE IF NOT EXISTS metrics (
+	"hash_id" LONG INDEX OFF,
+	"timestamp" TIMESTAMP,
+	"name" STRING,
+	"tags" OBJECT(DYNAMIC),
+	"fields" OBJECT(STRICT) AS ("price" NUMERIC(18, 4), "status" STRING, "usage_idle" DOUBLE),
+	"fields_extra" OBJECT(DYNAMIC),
+	PRIMARY KEY ("timestamp", "hash_id")
+);`, c.createSQL())
+
+	for _, typ := range []string{"", "OBJECT(DYNAMIC)", "DOUBLE) , \"x\" STRING", "LONG INDEX OFF", "FOO"} {
+		c.FieldObjectSchema = map[string]string{"usage_idle": typ}
+		require.Error(t, c.setup(), typ)
+	}
+	for _, typ := range []string{"long", "double precision", "TIMESTAMP WITH TIME ZONE", "ip", "numeric(10,2)"} {
+		c.FieldObjectSchema = map[string]string{"usage_idle": typ}
+		require.NoError(t, c.setup(), typ)
+	}
+	c.TypeSuffixKeys = true
+	require.Error(t, c.setup())
+}
+
+func Test_createSQLIndexColumns(t *testing.T) {
+	c := &CrateDB{
+		Table:            "metrics",
+		DisablePartition: true,
+		IndexOffColumns:  []string{"name", "fields"},
+		IndexColumns:     []string{"hash_id"},
+	}
+	require.NoError(t, c.setup())
+	require.Equal(t, `CREATE TABLE IF NOT EXISTS metrics (
+	"hash_id" LONG,
+	"timestamp" TIMESTAMP,
+	"name" STRING INDEX OFF,
+	"tags" OBJECT(DYNAMIC),
+	"fields" OBJECT(IGNORED),
+	PRIMARY KEY ("timestamp", "hash_id")
+);`, c.createSQL())
+	// The schema check ignores the index settings.
+	require.Empty(t, schemaDiff(c.schema(), map[string]string{
+		"hash_id": "bigint", "timestamp": "timestamp with time zone", "name": "text", "tags": "object", "fields": "object",
+	}))
+
+	for _, test := range []struct{ off, on []string }{
+		{off: []string{"unknown"}},
+		{on: []string{"unknown"}},
+		{off: []string{"name"}, on: []string{"name"}},
+	} {
+		c.IndexOffColumns, c.IndexColumns = test.off, test.on
+		require.Error(t, c.setup())
+	}
+	c.IndexOffColumns, c.IndexColumns = []string{"day"}, nil
+	c.DisablePartition = false
+	require.Error(t, c.setup())
+	c.IndexOffColumns = []string{"fields"}
+	c.FieldObjectSchema = map[string]string{"idle": "DOUBLE"}
+	require.Error(t, c.setup())
+}
+
+func Test_createSQLColumnStorage(t *testing.T) {
+	c := &CrateDB{
+		Table:            "metrics",
+		DisablePartition: true,
+		FieldsStorage:    "json_string",
+		IndexOffColumns:  []string{"fields"},
+		ColumnStorage:    map[string]string{"fields": " columnstore = false ", "name": "columnstore=false, x.y = 'a'"},
+	}
+	require.NoError(t, c.setup())
+	require.Equal(t, `CREATE TABLE IF NOT EXISTS metrics (
+	"hash_id" LONG INDEX OFF,
+	"timestamp" TIMESTAMP,
+	"name" STRING STORAGE WITH (columnstore=false, x.y = 'a'),
+	"tags" OBJECT(DYNAMIC),
+	"fields" STRING INDEX OFF STORAGE WITH (columnstore = false),
+	PRIMARY KEY ("timestamp", "hash_id")
+);`, c.createSQL())
+
+	for _, storage := range []map[string]string{
+		{"unknown": "columnstore = false"},
+		{"fields": ""},
+		{"fields": "columnstore"},
+		{"fields": "columnstore = false) INDEX OFF ("},
+		{"fields": "columnstore = 'it''s'"},
+	} {
+		c.ColumnStorage = storage
+		require.Error(t, c.setup(), "%v", storage)
+	}
+}
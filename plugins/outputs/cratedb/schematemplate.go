@@ -0,0 +1,164 @@
+package cratedb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/influxdata/telegraf"
+)
+
+// reservedSchemas can't be written to, so a tag can't direct metrics into
+// the system schemas of CrateDB.
+var reservedSchemas = map[string]bool{
+	"sys":                true,
+	"information_schema": true,
+	"pg_catalog":         true,
+	"blob":               true,
+}
+
+// schemaData is what SchemaTemplate is executed with.
+type schemaData struct {
+	m telegraf.Metric
+}
+
+// Name returns the name of the metric.
+func (d schemaData) Name() string {
+	return d.m.Name()
+}
+
+// Tag returns the value of the tag key of the metric, or "" if it has none.
+func (d schemaData) Tag(key string) string {
+	return d.m.Tags()[key]
+}
+
+// schemaTables holds the schemas of SchemaTemplate whose table was created
+// and checked since connecting.
+type schemaTables struct {
+	mu      sync.Mutex
+	schemas map[string]bool
+}
+
+// parseSchemaTemplate parses SchemaTemplate, or returns nil if it's not set.
+func (c *CrateDB) parseSchemaTemplate() (*template.Template, error) {
+	if c.SchemaTemplate == "" {
+		return nil, nil
+	} else if strings.Contains(c.Table, ".") {
+		return nil, fmt.Errorf("schema_template requires a table without schema, got %q", c.Table)
+	} else if c.StagingTable != "" {
+		return nil, fmt.Errorf("schema_template can't be used with staging_table")
+	}
+	tmpl, err := template.New("schema_template").Parse(c.SchemaTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema_template: %s", err)
+	}
+	return tmpl, nil
+}
+
+// metricSchema returns the schema SchemaTemplate yields for m, or "" if
+// Table is written to as configured.
+func (c *CrateDB) metricSchema(m telegraf.Metric) (string, error) {
+	if c.schemaTemplate == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := c.schemaTemplate.Execute(&buf, schemaData{m: m}); err != nil {
+		return "", fmt.Errorf("%s: schema_template: %s", m.Name(), err)
+	}
+	schema := sanitizeSchema(buf.String())
+	if reservedSchemas[schema] {
+		return "", fmt.Errorf("%s: schema_template: schema %q is reserved", m.Name(), schema)
+	}
+	return schema, nil
+}
+
+// schemaTable returns the name of Table in schema as used in statements, or
+// the table written to as configured if schema is empty.
+func (c *CrateDB) schemaTable(schema string) string {
+	if schema == "" {
+		return c.writeTable()
+	}
+	// The schema is always quoted, since it consists of user data.
+	return escapeString(schema, `"`) + "." + c.Table
+}
+
+// sanitizeSchema returns s as a valid schema name, lowercased and with
+// anything but letters, digits and "_" replaced with "_". Leading "_" are
+// removed, since CrateDB doesn't allow them.
+func sanitizeSchema(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+	return strings.TrimLeft(s, "_")
+}
+
+// groupBySchema splits metrics by the schema metricSchema returns for them,
+// in the order the schemas first occur. Metrics for which there is no valid
+// schema are logged and skipped.
+func (c *CrateDB) groupBySchema(metrics []telegraf.Metric) ([]string, [][]telegraf.Metric) {
+	var (
+		schemas []string
+		groups  [][]telegraf.Metric
+		index   = make(map[string]int)
+	)
+	for _, m := range metrics {
+		schema, err := c.metricSchema(m)
+		if err != nil {
+			log.Printf("W! CrateDB: skipped metric: %s", err)
+			continue
+		}
+		i, ok := index[schema]
+		if !ok {
+			i = len(groups)
+			index[schema] = i
+			schemas = append(schemas, schema)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return schemas, groups
+}
+
+// initSchema creates the table of schema if TableCreate is set and checks it
+// according to SchemaCheck the first time the schema is written to since
+// connecting, like initDB does for Table.
+func (c *CrateDB) initSchema(schema string) error {
+	if schema == "" {
+		return nil
+	}
+	c.schemaTables.mu.Lock()
+	defer c.schemaTables.mu.Unlock()
+	if c.schemaTables.schemas[schema] {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout.Duration)
+	defer cancel()
+	c.dbMu.RLock()
+	db := c.DB
+	c.dbMu.RUnlock()
+	table := c.schemaTable(schema)
+	if c.TableCreate {
+		if _, err := db.ExecContext(ctx, c.createTableSQL(table)); err != nil {
+			return fmt.Errorf("creating table %s failed: %s", table, err)
+		}
+	}
+	if err := c.checkTableSchema(ctx, db, schema, c.Table); err != nil {
+		return err
+	}
+	if c.schemaTables.schemas == nil {
+		c.schemaTables.schemas = make(map[string]bool)
+	}
+	c.schemaTables.schemas[schema] = true
+	return nil
+}
@@ -0,0 +1,110 @@
+package cratedb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSchemaTemplate(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	newMetric := func(tags map[string]string) telegraf.Metric {
+		m, err := metric.New("cpu", tags, map[string]interface{}{"idle": 0.5}, now)
+		require.NoError(t, err)
+		return m
+	}
+
+	// dropped is a table whose INSERTs fail until it's created again.
+	var dropped string
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if dropped == "" {
+				return nil
+			} else if strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS "+dropped+" ") {
+				dropped = ""
+			} else if strings.HasPrefix(query, "INSERT INTO "+dropped+" (") {
+				return &pq.Error{Code: "42P01", Message: "RelationUnknown: Relation '" + dropped + "' unknown"}
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		Table:          "metrics",
+		Timeout:        internal.Duration{Duration: time.Second * 5},
+		TableCreate:    true,
+		SchemaTemplate: `tenant_{{ .Tag "tenant" }}`,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	metrics := []telegraf.Metric{
+		newMetric(map[string]string{"tenant": "Acme"}),
+		newMetric(map[string]string{"tenant": "globex"}),
+		newMetric(map[string]string{"tenant": "acme"}),
+		newMetric(map[string]string{"tenant": `x"; DROP TABLE metrics; --`}),
+	}
+	require.NoError(t, c.Write(metrics))
+	stmts := fd.statements()
+	require.Len(t, stmts, 6)
+	// The table of a schema is created before its first write.
+	for i, table := range []string{`"tenant_acme".metrics`, `"tenant_globex".metrics`, `"tenant_x___drop_table_metrics____".metrics`} {
+		require.Equal(t, c.createTableSQL(table), stmts[2*i])
+		require.True(t, strings.HasPrefix(stmts[2*i+1], "INSERT INTO "+table+" ("), stmts[2*i+1])
+	}
+	require.Equal(t, 2, strings.Count(stmts[1], "'cpu'"))
+
+	// Known schemas are not created again.
+	require.NoError(t, c.Write(metrics[:1]))
+	require.Len(t, fd.statements(), 7)
+
+	// A dropped table is created again and the batch retried.
+	dropped = `"tenant_acme".metrics`
+	require.NoError(t, c.Write(metrics[:1]))
+	stmts = fd.statements()[7:]
+	require.Len(t, stmts, 3)
+	require.Equal(t, c.createTableSQL(`"tenant_acme".metrics`), stmts[1])
+	require.Equal(t, stmts[0], stmts[2])
+
+	// An empty schema writes to the configured table, reserved ones are
+	// skipped.
+	c.SchemaTemplate = `{{ .Tag "tenant" }}`
+	require.NoError(t, c.setup())
+	require.NoError(t, c.Write([]telegraf.Metric{
+		newMetric(map[string]string{}),
+		newMetric(map[string]string{"tenant": "SYS"}),
+	}))
+	stmts = fd.statements()[10:]
+	require.Len(t, stmts, 1)
+	require.True(t, strings.HasPrefix(stmts[0], "INSERT INTO metrics ("), stmts[0])
+	require.Equal(t, 1, strings.Count(stmts[0], "'cpu'"))
+
+	c.Table = "doc.metrics"
+	require.Error(t, c.setup())
+	c.Table = "metrics"
+	c.StagingTable = "metrics_staging"
+	require.Error(t, c.setup())
+	c.StagingTable = ""
+	c.SchemaTemplate = `{{ .Tag "tenant" `
+	require.Error(t, c.setup())
+}
+
+func Test_sanitizeSchema(t *testing.T) {
+	for in, want := range map[string]string{
+		"tenant_1":    "tenant_1",
+		"Tenant-One":  "tenant_one",
+		"__internal":  "internal",
+		`a"b.c`:       "a_b_c",
+		"münchen":     "m_nchen",
+		"":            "",
+		"___":         "",
+		"tenant 2 ab": "tenant_2_ab",
+	} {
+		require.Equal(t, want, sanitizeSchema(in), in)
+	}
+}
@@ -0,0 +1,114 @@
+package cratedb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+)
+
+// sequence assigns a monotonically increasing number to every metric that's
+// written, for the SequenceColumn. If path is set, the last assigned number
+// is stored in this file, so the numbers continue after a restart.
+type sequence struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	last   int64
+	// numbers holds the numbers of the metrics of the batches being written.
+	numbers map[telegraf.Metric]int64
+}
+
+// assign assigns consecutive numbers to metrics, which are looked up by
+// number until release is called. The numbers are stored before they're
+// used, so a crash can skip numbers, but never repeats them.
+func (s *sequence) assign(metrics []telegraf.Metric) (release func(), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		if s.last, err = s.load(); err != nil {
+			return nil, err
+		}
+		s.loaded = true
+	}
+	if err := s.store(s.last + int64(len(metrics))); err != nil {
+		return nil, err
+	}
+	if s.numbers == nil {
+		s.numbers = make(map[telegraf.Metric]int64)
+	}
+	for _, m := range metrics {
+		s.last++
+		s.numbers[m] = s.last
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, m := range metrics {
+			delete(s.numbers, m)
+		}
+	}, nil
+}
+
+// number returns the number assigned to m, or nil if it has none.
+func (s *sequence) number(m telegraf.Metric) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.numbers[m]; ok {
+		return n
+	}
+	return nil
+}
+
+// load returns the last number stored in the state file, or 0 if there is
+// none yet.
+func (s *sequence) load() (int64, error) {
+	if s.path == "" {
+		return 0, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("sequence_state_file: %s", err)
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || last < 0 {
+		return 0, fmt.Errorf("sequence_state_file: invalid state in %s: %q", s.path, data)
+	}
+	return last, nil
+}
+
+// store stores last in the state file, replacing it atomically.
+func (s *sequence) store(last int64) error {
+	if s.path == "" {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(last, 10)+"\n"), 0644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("sequence_state_file: %s", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("sequence_state_file: %s", err)
+	}
+	return nil
+}
+
+// sequenceColumn returns a LONG column of the given name holding the number
+// the sequence assigned to the metric.
+func (c *CrateDB) sequenceColumn(name string) column {
+	return column{
+		Name: name,
+		Type: "LONG",
+		Value: func(m telegraf.Metric, tags map[string]string, fields map[string]interface{}) (interface{}, error) {
+			return c.seq.number(m), nil
+		},
+	}
+}
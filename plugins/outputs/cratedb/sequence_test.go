@@ -0,0 +1,103 @@
+package cratedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceRe matches the value of the last column of a row.
+var sequenceRe = regexp.MustCompile(`, (\d+|NULL)\)`)
+
+func sequenceNumbers(stmts []string) []string {
+	var numbers []string
+	for _, stmt := range stmts {
+		for _, match := range sequenceRe.FindAllStringSubmatch(stmt, -1) {
+			numbers = append(numbers, match[1])
+		}
+	}
+	return numbers
+}
+
+func TestWriteSequenceColumn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cratedb-sequence")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "cratedb.seq")
+
+	newOutput := func(fd *fakeDriver) *CrateDB {
+		c := &CrateDB{
+			Table:             "my_table",
+			Timeout:           internal.Duration{Duration: time.Second * 5},
+			SequenceColumn:    "seq",
+			SequenceStateFile: state,
+		}
+		require.NoError(t, c.setup())
+		c.DB = fd.open(t)
+		return c
+	}
+	batch := func(n int) []telegraf.Metric {
+		var metrics []telegraf.Metric
+		for i := 0; i < n; i++ {
+			metrics = append(metrics, testutil.TestMetric(float64(i)))
+		}
+		return metrics
+	}
+
+	fd := &fakeDriver{}
+	c := newOutput(fd)
+	require.Contains(t, c.createSQL(), `"seq" LONG,`)
+	require.NoError(t, c.Write(batch(2)))
+	require.NoError(t, c.Write(batch(1)))
+	require.Equal(t, []string{"1", "2", "3"}, sequenceNumbers(fd.statements()))
+	data, err := ioutil.ReadFile(state)
+	require.NoError(t, err)
+	require.Equal(t, "3\n", string(data))
+
+	// Metrics are only numbered while they're written.
+	got, err := c.insertSQL(batch(1), time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, []string{"NULL"}, sequenceNumbers([]string{got}))
+
+	// The numbers continue after a restart, and are unique across
+	// concurrent writes.
+	fd = &fakeDriver{}
+	c = newOutput(fd)
+	c.MaxConcurrentWrites = 4
+	require.NoError(t, c.setup())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, c.Write(batch(5)))
+		}()
+	}
+	wg.Wait()
+	numbers := sequenceNumbers(fd.statements())
+	ints := make([]int, len(numbers))
+	for i, n := range numbers {
+		ints[i], err = strconv.Atoi(n)
+		require.NoError(t, err)
+	}
+	sort.Ints(ints)
+	for i, n := range ints {
+		require.Equal(t, i+4, n)
+	}
+	require.Len(t, c.seq.numbers, 0)
+
+	require.NoError(t, ioutil.WriteFile(state, []byte("garbage"), 0644))
+	c = newOutput(&fakeDriver{})
+	require.Error(t, c.Write(batch(1)))
+}
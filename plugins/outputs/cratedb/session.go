@@ -0,0 +1,73 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"time"
+)
+
+// sessionConnector is a driver.Connector that runs a list of statements, e.g.
+// SET SESSION statements, on every connection it opens.
+type sessionConnector struct {
+	dsn    string
+	driver driver.Driver
+	stmts  []string
+	// open opens the connections instead of the driver if set.
+	open func(dsn string) (driver.Conn, error)
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	open := c.driver.Open
+	if c.open != nil {
+		open = c.open
+	}
+	conn, err := open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range c.stmts {
+		if err := execConn(ctx, conn, stmt); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *sessionConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// keepAliveDialer is a pq.Dialer enabling TCP keepalive with the given
+// period on its connections.
+type keepAliveDialer struct {
+	keepAlive time.Duration
+}
+
+func (d keepAliveDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, 0)
+}
+
+func (d keepAliveDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: d.keepAlive}
+	return dialer.Dial(network, address)
+}
+
+// execConn executes stmt on conn, using the optional interfaces of the driver
+// if available.
+func execConn(ctx context.Context, conn driver.Conn, stmt string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, stmt, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	s, err := conn.Prepare(stmt)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_, err = s.Exec(nil)
+	return err
+}
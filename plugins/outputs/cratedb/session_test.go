@@ -0,0 +1,170 @@
+package cratedb
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectServerStatementTimeout(t *testing.T) {
+	defer useFakeDriver()()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:                    fd.dsn(t),
+		Table:                  "metrics",
+		Timeout:                internal.Duration{Duration: time.Second * 5},
+		ServerStatementTimeout: internal.Duration{Duration: 1500 * time.Millisecond},
+		WarmupConnections:      3,
+	}
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Close())
+
+	var sets, inserts int
+	for _, stmt := range fd.statements() {
+		switch {
+		case stmt == "SET SESSION statement_timeout = '1500ms'":
+			sets++
+		case strings.HasPrefix(stmt, "INSERT INTO metrics"):
+			inserts++
+		default:
+			t.Errorf("unexpected statement: %s", stmt)
+		}
+	}
+	// Once per connection.
+	require.Equal(t, 3, sets)
+	require.Equal(t, 1, inserts)
+	require.Equal(t, 0, fd.openConns())
+
+	fd = &fakeDriver{
+		exec: func(query string) error {
+			return errors.New("unknown setting")
+		},
+	}
+	c.URL = fd.dsn(t)
+	require.EqualError(t, c.Connect(), "unknown setting")
+	require.Equal(t, 0, fd.openConns())
+}
+
+func TestConnectTimezone(t *testing.T) {
+	defer useFakeDriver()()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:        fd.dsn(t),
+		Table:      "metrics",
+		Timeout:    internal.Duration{Duration: time.Second * 5},
+		Timezone:   "Europe/Berlin",
+		SplitByDay: true,
+	}
+	require.NoError(t, c.Connect())
+	// 2009-11-10T23:00:00 UTC is the next day in Berlin.
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Close())
+	stmts := fd.statements()
+	require.Len(t, stmts, 2)
+	require.Equal(t, "SET TIME ZONE 'Europe/Berlin'", stmts[0])
+	require.Contains(t, stmts[1], "'2009-11-11T00:00:00+0100'")
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	var metrics []telegraf.Metric
+	for _, ts := range []time.Time{
+		time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
+		time.Date(2009, time.November, 10, 22, 0, 0, 0, time.UTC),
+	} {
+		m, err := metric.New("cpu", map[string]string{}, map[string]interface{}{"idle": 0.5}, ts)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.Len(t, groupByDay(metrics, time.UTC), 1)
+	require.Len(t, groupByDay(metrics, berlin), 2)
+
+	for _, tz := range []string{"Local", "Mars/Olympus", "UTC'"} {
+		c.Timezone = tz
+		require.Error(t, c.setup(), tz)
+	}
+}
+
+func TestConnectURLFile(t *testing.T) {
+	defer useFakeDriver()()
+
+	dir, err := ioutil.TempDir("", "cratedb-url")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "url")
+
+	first, second := &fakeDriver{}, &fakeDriver{}
+	require.NoError(t, ioutil.WriteFile(path, []byte("  "+first.dsn(t)+"\n"), 0600))
+	c := &CrateDB{
+		URL:     "postgres://ignored",
+		URLFile: path,
+		Table:   "metrics",
+		Timeout: internal.Duration{Duration: time.Second * 5},
+	}
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, first.statements(), 1)
+
+	// Rotated credentials are picked up when reconnecting.
+	require.NoError(t, ioutil.WriteFile(path, []byte(second.dsn(t)), 0600))
+	require.NoError(t, c.reconnect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, first.statements(), 1)
+	require.Len(t, second.statements(), 1)
+	require.NoError(t, c.Close())
+
+	// Errors don't contain the connection string.
+	var dsn string
+	failing := &fakeDriver{
+		exec: func(query string) error {
+			return errors.New("invalid connection string " + dsn)
+		},
+	}
+	dsn = failing.dsn(t)
+	require.NoError(t, ioutil.WriteFile(path, []byte(dsn), 0600))
+	c.TableCreate = true
+	require.EqualError(t, c.Connect(), "invalid connection string <redacted url>")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(" \n"), 0600))
+	require.Error(t, c.Connect())
+	require.NoError(t, os.Remove(path))
+	require.Error(t, c.Connect())
+}
+
+func TestConnectTCPKeepAlive(t *testing.T) {
+	defer useFakeDriver()()
+	var dialers []pq.Dialer
+	dialOpen = func(d pq.Dialer, dsn string) (driver.Conn, error) {
+		dialers = append(dialers, d)
+		return fakeDispatcher{}.Open(dsn)
+	}
+	defer func() { dialOpen = pq.DialOpen }()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:          fd.dsn(t),
+		Table:        "metrics",
+		Timeout:      internal.Duration{Duration: time.Second * 5},
+		TCPKeepAlive: internal.Duration{Duration: 30 * time.Second},
+	}
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Close())
+	require.NotEmpty(t, dialers)
+	require.Equal(t, keepAliveDialer{keepAlive: 30 * time.Second}, dialers[0])
+	require.Equal(t, 0, fd.openConns())
+}
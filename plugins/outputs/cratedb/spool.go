@@ -0,0 +1,219 @@
+package cratedb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSpoolFull is returned by spool.add if a statement would exceed the
+// maximum size of the spool.
+var errSpoolFull = errors.New("spool is full")
+
+const (
+	spoolSuffix  = ".sql"
+	gzipSuffix   = ".gz"
+	failedSuffix = ".failed"
+	// tableHeader starts the first line of a spooled statement naming the
+	// table it writes to. It's a comment, so the file is still valid SQL.
+	tableHeader = "-- table "
+)
+
+// spool persists INSERT statements that could not be written to CrateDB in a
+// directory, so they can be replayed in order once CrateDB is available
+// again.
+type spool struct {
+	dir      string
+	maxBytes int64
+	// level is the gzip compression level of new files, or 0 if they are
+	// stored uncompressed.
+	level int
+
+	mu  sync.Mutex
+	seq int
+}
+
+// newSpool returns a spool storing its files in dir, creating dir if needed.
+// If maxBytes is greater than 0, the spool refuses to grow beyond it. If
+// level is greater than 0, new files are compressed with gzip at this level.
+func newSpool(dir string, maxBytes int64, level int) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, maxBytes: maxBytes, level: level}, nil
+}
+
+// files returns the names of the spooled statements and of the statements
+// set aside by replay, oldest first, and the total size of both in bytes.
+func (s *spool) files() (names, failed []string, size int64, err error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		switch name := info.Name(); {
+		// Compressed and uncompressed files are replayed alike, so the
+		// compression level can be changed at any time.
+		case strings.HasSuffix(name, spoolSuffix), strings.HasSuffix(name, spoolSuffix+gzipSuffix):
+			names = append(names, name)
+		case strings.HasSuffix(name, failedSuffix):
+			failed = append(failed, name)
+		default:
+			continue
+		}
+		size += info.Size()
+	}
+	// The names start with a fixed width timestamp, so sorting them sorts
+	// them by age.
+	sort.Strings(names)
+	sort.Strings(failed)
+	return names, failed, size, nil
+}
+
+// add persists an INSERT statement writing to table.
+func (s *spool) add(table, stmt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if table != "" {
+		stmt = tableHeader + table + "\n" + stmt
+	}
+	data, suffix := []byte(stmt), spoolSuffix
+	if s.level > 0 {
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, s.level)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data, suffix = buf.Bytes(), spoolSuffix+gzipSuffix
+	}
+
+	_, failed, size, err := s.files()
+	if err != nil {
+		return err
+	}
+	// Statements set aside by replay count towards maxBytes, but are removed,
+	// oldest first, to make room for statements that can still be written.
+	for s.maxBytes > 0 && size+int64(len(data)) > s.maxBytes && len(failed) > 0 {
+		path := filepath.Join(s.dir, failed[0])
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("W! CrateDB: removing failed spool file %s to make room", path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		size -= info.Size()
+		failed = failed[1:]
+	}
+	if s.maxBytes > 0 && size+int64(len(data)) > s.maxBytes {
+		return errSpoolFull
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, suffix)
+	// Write to a temporary file first, so replay never sees a partially
+	// written statement.
+	tmp := filepath.Join(s.dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+// empty returns true if there are no spooled statements.
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, _, _, err := s.files()
+	return err == nil && len(names) == 0
+}
+
+// replay passes the spooled statements and their table to exec, oldest
+// first, and removes them once exec succeeds. The table is empty for
+// statements spooled without one. It stops at the first error for which retry
+// returns true. Statements failing with other errors are set aside by
+// renaming them with a ".failed" suffix, so they don't block the spool.
+func (s *spool) replay(exec func(table, stmt string) error, retry func(err error) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, _, _, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		stmt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, gzipSuffix) {
+			if stmt, err = gunzip(stmt); err != nil {
+				// The file is truncated or corrupt, e.g. because the disk
+				// filled up, so replaying it again won't help.
+				log.Printf("E! CrateDB: setting aside corrupt spool file %s: %s", path, err)
+				if err := os.Rename(path, path+failedSuffix); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := exec(splitTable(string(stmt))); err != nil {
+			if retry(err) {
+				return err
+			}
+			log.Printf("E! CrateDB: setting aside spooled statement %s: %s", path, err)
+			if err := os.Rename(path, path+failedSuffix); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitTable returns the table of a spooled statement, or "" if it has none,
+// and the statement without its table header.
+func splitTable(stmt string) (string, string) {
+	if !strings.HasPrefix(stmt, tableHeader) {
+		return "", stmt
+	}
+	i := strings.IndexByte(stmt, '\n')
+	if i < 0 {
+		return "", stmt
+	}
+	return stmt[len(tableHeader):i], stmt[i+1:]
+}
+
+// gunzip returns the decompressed content of a gzip file.
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
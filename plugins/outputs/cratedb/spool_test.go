@@ -0,0 +1,149 @@
+package cratedb
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cratedb-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(filepath.Join(dir, "spool"), 10, 0)
+	require.NoError(t, err)
+	require.True(t, s.empty())
+
+	require.NoError(t, s.add("", "one"))
+	require.NoError(t, s.add("", "two"))
+	require.NoError(t, s.add("", "six"))
+	require.Equal(t, errSpoolFull, s.add("", "four"))
+	require.False(t, s.empty())
+
+	// A retryable error stops the replay and keeps the statements.
+	var replayed []string
+	down := errors.New("connection refused")
+	err = s.replay(func(table, stmt string) error {
+		replayed = append(replayed, stmt)
+		if stmt == "two" {
+			return down
+		}
+		return nil
+	}, isRetryable)
+	require.Equal(t, down, err)
+	require.Equal(t, []string{"one", "two"}, replayed)
+
+	// Statements rejected by CrateDB are set aside.
+	replayed = nil
+	err = s.replay(func(table, stmt string) error {
+		replayed = append(replayed, stmt)
+		if stmt == "two" {
+			return &pq.Error{Message: "SQLParseException"}
+		}
+		return nil
+	}, isRetryable)
+	require.NoError(t, err)
+	require.Equal(t, []string{"two", "six"}, replayed)
+	require.True(t, s.empty())
+
+	failed, err := filepath.Glob(filepath.Join(dir, "spool", "*"+failedSuffix))
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+
+	// Statements set aside count towards the maximum size, and are removed
+	// to make room for new ones.
+	require.NoError(t, s.add("", "seven!!"))
+	require.NoError(t, s.add("", "ten"))
+	failed, err = filepath.Glob(filepath.Join(dir, "spool", "*"+failedSuffix))
+	require.NoError(t, err)
+	require.Len(t, failed, 0)
+	require.Equal(t, errSpoolFull, s.add("", "x"))
+}
+
+func TestSpoolCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cratedb-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stmt := "INSERT INTO my_table VALUES " + strings.Repeat("(1, 'a'), ", 1000)
+	plain, err := newSpool(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, plain.add("", "plain"))
+	s, err := newSpool(dir, 0, gzip.BestCompression)
+	require.NoError(t, err)
+	require.NoError(t, s.add("", stmt))
+	require.NoError(t, s.add("", "corrupt"))
+	require.NoError(t, s.add(`"tenant_acme".metrics`, "last"))
+
+	names, _, size, err := s.files()
+	require.NoError(t, err)
+	require.Len(t, names, 4)
+	require.True(t, strings.HasSuffix(names[1], spoolSuffix+gzipSuffix))
+	require.True(t, size < int64(len(stmt)))
+
+	// Truncate the third file, as if the disk filled up.
+	path := filepath.Join(dir, names[2])
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, data[:len(data)-4], 0644))
+
+	// Compressed and uncompressed files are replayed, corrupt ones are set
+	// aside.
+	var replayed, tables []string
+	require.NoError(t, s.replay(func(table, stmt string) error {
+		replayed = append(replayed, stmt)
+		tables = append(tables, table)
+		return nil
+	}, isRetryable))
+	require.Equal(t, []string{"plain", stmt, "last"}, replayed)
+	require.Equal(t, []string{"", "", `"tenant_acme".metrics`}, tables)
+	require.True(t, s.empty())
+	_, err = os.Stat(path + failedSuffix)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table", SpoolCompressionLevel: 10}
+	require.Error(t, c.setup())
+}
+
+func TestWriteSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cratedb-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var down bool
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if down {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{Table: "my_table", Timeout: internal.Duration{Duration: time.Second * 5}}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+	c.spool, err = newSpool(dir, 0, 0)
+	require.NoError(t, err)
+
+	down = true
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.False(t, c.spool.empty())
+
+	down = false
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.True(t, c.spool.empty())
+	// 2 failed attempts and 3 successful writes.
+	require.Len(t, fd.statements(), 5)
+}
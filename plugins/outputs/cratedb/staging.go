@@ -0,0 +1,85 @@
+package cratedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// staging tracks the load into the StagingTable, which is swapped with the
+// metrics table once it's complete.
+type staging struct {
+	// mu is held for reading by writes and for writing by swaps, so no
+	// statement built for the staging table is executed after the swap.
+	mu     sync.RWMutex
+	active bool
+	// rows counts the rows written to the StagingTable by the current load.
+	// It's reported as stagingRows, which is shared by all outputs writing
+	// the table.
+	rows int64
+}
+
+// startStaging creates an empty StagingTable that the following writes go
+// to, dropping the table of a previous load.
+func (c *CrateDB) startStaging(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range []string{
+		`DROP TABLE IF EXISTS ` + c.StagingTable,
+		c.createTableSQL(c.StagingTable),
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("staging_table: %s", err)
+		}
+	}
+	c.staging.mu.Lock()
+	c.staging.active = true
+	atomic.StoreInt64(&c.staging.rows, 0)
+	c.stagingRows.Set(0)
+	c.staging.mu.Unlock()
+	return nil
+}
+
+// writeTable returns the table INSERT statements write to, which is the
+// StagingTable until it was swapped.
+func (c *CrateDB) writeTable() string {
+	if c.staging.active {
+		return c.StagingTable
+	}
+	return c.Table
+}
+
+// stagingWritten counts n rows written to the StagingTable. The staging.mu
+// has to be held.
+func (c *CrateDB) stagingWritten(n int) {
+	if c.staging.active {
+		c.stagingRows.Set(atomic.AddInt64(&c.staging.rows, int64(n)))
+	}
+}
+
+// swapDue returns true if the load into the StagingTable is complete
+// according to StagingSwapRows.
+func (c *CrateDB) swapDue() bool {
+	c.staging.mu.RLock()
+	defer c.staging.mu.RUnlock()
+	return c.staging.active && c.StagingSwapRows > 0 && atomic.LoadInt64(&c.staging.rows) >= c.StagingSwapRows
+}
+
+// swapStaging swaps the StagingTable with the metrics table, so all rows of
+// the load become visible at once, if it's not swapped yet. The previous
+// rows of the metrics table are in the StagingTable afterwards, until the
+// next load drops it. Later writes go to the metrics table.
+func (c *CrateDB) swapStaging() error {
+	c.staging.mu.Lock()
+	defer c.staging.mu.Unlock()
+	if !c.staging.active {
+		return nil
+	}
+	if err := c.exec(`ALTER CLUSTER SWAP TABLE ` + c.StagingTable + ` TO ` + c.Table); err != nil {
+		return fmt.Errorf("staging_table: swapping %s to %s failed: %s", c.StagingTable, c.Table, err)
+	}
+	c.staging.active = false
+	log.Printf("I! CrateDB: swapped %s with %d rows to %s", c.StagingTable, atomic.LoadInt64(&c.staging.rows), c.Table)
+	return nil
+}
@@ -0,0 +1,66 @@
+package cratedb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStagingTable(t *testing.T) {
+	defer useFakeDriver()()
+
+	fd := &fakeDriver{}
+	c := &CrateDB{
+		URL:             fd.dsn(t),
+		Table:           "metrics",
+		TableCreate:     true,
+		Timeout:         internal.Duration{Duration: time.Second * 5},
+		StagingTable:    "metrics_staging",
+		StagingSwapRows: 2,
+	}
+	require.NoError(t, c.Connect())
+	stmts := fd.statements()
+	require.Len(t, stmts, 3)
+	require.Equal(t, c.createSQL(), stmts[0])
+	require.Equal(t, `DROP TABLE IF EXISTS metrics_staging`, stmts[1])
+	require.Equal(t, c.createTableSQL("metrics_staging"), stmts[2])
+
+	// The load is swapped once it has 2 rows.
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.True(t, strings.HasPrefix(fd.statements()[3], "INSERT INTO metrics_staging "))
+	require.Len(t, fd.statements(), 4)
+	// The rows written by another output to the same table don't count.
+	other := &CrateDB{Table: c.Table}
+	require.NoError(t, other.setup())
+	other.stagingRows.Incr(100)
+	require.False(t, c.swapDue())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.Len(t, fd.statements(), 6)
+	require.True(t, strings.HasPrefix(fd.statements()[4], "INSERT INTO metrics_staging "))
+	require.Equal(t, `ALTER CLUSTER SWAP TABLE metrics_staging TO metrics`, fd.statements()[5])
+	require.Equal(t, int64(2), c.stagingRows.Get())
+
+	// Later writes go to the metrics table.
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.True(t, strings.HasPrefix(fd.statements()[6], "INSERT INTO metrics "))
+	require.NoError(t, c.Close())
+	require.Len(t, fd.statements(), 7)
+
+	// An incomplete load is swapped on shutdown.
+	c.StagingSwapRows = 0
+	require.NoError(t, c.Connect())
+	require.NoError(t, c.Write(testutil.MockMetrics()))
+	require.True(t, strings.HasPrefix(fd.statements()[10], "INSERT INTO metrics_staging "))
+	require.NoError(t, c.Close())
+	require.Equal(t, `ALTER CLUSTER SWAP TABLE metrics_staging TO metrics`, fd.statements()[11])
+
+	c.StagingTable = "metrics"
+	require.Error(t, c.setup())
+	c.StagingTable = "metrics_staging"
+	c.SpoolDir = t.Name()
+	require.Error(t, c.setup())
+}
@@ -0,0 +1,87 @@
+package cratedb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FieldTransform is a rule of the field_transform option that converts the
+// values of the fields whose whole key matches Pattern with the built-in
+// Transform, e.g. to store durations in nanoseconds as seconds.
+type FieldTransform struct {
+	Pattern   string `toml:"pattern"`
+	Transform string `toml:"transform"`
+}
+
+// fieldTransform is a compiled FieldTransform.
+type fieldTransform struct {
+	re     *regexp.Regexp
+	factor float64
+}
+
+// fieldTransforms are the built-in transforms of field_transform. All of
+// them convert a unit by multiplying the value with a factor.
+var fieldTransforms = map[string]float64{
+	"ns_to_us":       1e-3,
+	"ns_to_ms":       1e-6,
+	"ns_to_s":        1e-9,
+	"us_to_ms":       1e-3,
+	"us_to_s":        1e-6,
+	"ms_to_s":        1e-3,
+	"bytes_to_kb":    1e-3,
+	"bytes_to_mb":    1e-6,
+	"bytes_to_gb":    1e-9,
+	"bytes_to_kib":   1.0 / (1 << 10),
+	"bytes_to_mib":   1.0 / (1 << 20),
+	"bytes_to_gib":   1.0 / (1 << 30),
+	"bits_to_bytes":  1.0 / 8,
+	"percent_to_one": 1e-2,
+}
+
+// compileFieldTransforms compiles the field_transform rules.
+func compileFieldTransforms(rules []FieldTransform) ([]fieldTransform, error) {
+	compiled := make([]fieldTransform, 0, len(rules))
+	for _, rule := range rules {
+		factor, ok := fieldTransforms[rule.Transform]
+		if !ok {
+			names := make([]string, 0, len(fieldTransforms))
+			for name := range fieldTransforms {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("field_transform: unknown transform %q, expected one of %s", rule.Transform, strings.Join(names, ", "))
+		}
+		re, err := regexp.Compile(`^(?:` + rule.Pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("field_transform: %s", err)
+		}
+		compiled = append(compiled, fieldTransform{re: re, factor: factor})
+	}
+	return compiled, nil
+}
+
+// transformFields converts the values of fields in place with the first
+// rule matching their key. Values that are not numbers are kept.
+func (c *CrateDB) transformFields(fields map[string]interface{}) {
+	if len(c.fieldTransforms) == 0 {
+		return
+	}
+	for k, v := range fields {
+		for _, t := range c.fieldTransforms {
+			if !t.re.MatchString(k) {
+				continue
+			}
+			switch n := v.(type) {
+			case int64:
+				fields[k] = float64(n) * t.factor
+			case uint64:
+				fields[k] = float64(n) * t.factor
+			case float64:
+				fields[k] = n * t.factor
+			}
+			break
+		}
+	}
+}
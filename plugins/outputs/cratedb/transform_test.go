@@ -0,0 +1,48 @@
+package cratedb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_insertSQLFieldTransform(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New("http", map[string]string{}, map[string]interface{}{
+		"duration_ns":       int64(1500000000),
+		"duration_ns_count": int64(3),
+		"bytes":             uint64(2500000),
+		"usage":             12.5,
+		"status_ns":         "ok",
+	}, now)
+	require.NoError(t, err)
+
+	c := &CrateDB{
+		Table: "my_table",
+		FieldTransform: []FieldTransform{
+			{Pattern: ".*_ns", Transform: "ns_to_s"},
+			{Pattern: "duration_ns", Transform: "ns_to_ms"},
+			{Pattern: "bytes", Transform: "bytes_to_mb"},
+			{Pattern: "usage", Transform: "percent_to_one"},
+		},
+		KeyRewrite: []KeyRewrite{{Pattern: "_ns$", Replacement: "_s"}},
+	}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(`
+INSERT INTO my_table ("hash_id", "timestamp", "name", "tags", "fields")
+VALUES
+(`+fmt.Sprint(int64(m.HashID()))+`, '2009-11-10T23:00:00+0000', 'http', {}, {"bytes" = 2.5, "duration_ns_count" = 3, "duration_s" = 1.5, "status_s" = 'ok', "usage" = 0.125});
+`), got)
+
+	c.FieldTransform = []FieldTransform{{Pattern: "bytes", Transform: "bytes_to_furlongs"}}
+	require.Error(t, c.setup())
+	c.FieldTransform = []FieldTransform{{Pattern: "(", Transform: "ns_to_s"}}
+	require.Error(t, c.setup())
+}
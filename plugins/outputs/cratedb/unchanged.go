@@ -0,0 +1,107 @@
+package cratedb
+
+import (
+	"container/list"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// lastValues remembers the fields of the last metric written for each series,
+// so metrics whose fields did not change can be dropped. It holds at most
+// maxSize series and evicts the least recently written ones beyond that.
+type lastValues struct {
+	maxSize      int
+	maxStaleness time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// lastValue is the value of a lastValues entry.
+type lastValue struct {
+	series string
+	fields map[string]interface{}
+	time   time.Time
+}
+
+// newLastValues returns an empty lastValues holding at most maxSize series.
+// If maxStaleness is greater than 0, a metric is never dropped if the last
+// written metric of its series is at least maxStaleness older.
+func newLastValues(maxSize int, maxStaleness time.Duration) *lastValues {
+	return &lastValues{
+		maxSize:      maxSize,
+		maxStaleness: maxStaleness,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// filter returns the metrics whose fields differ from the last written metric
+// of their series, comparing metrics of the same series within the batch as
+// well. It does not remember the returned metrics, which is up to update
+// once they have been written.
+func (l *lastValues) filter(metrics []telegraf.Metric) []telegraf.Metric {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	batch := make(map[string]*lastValue)
+	kept := make([]telegraf.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		series := seriesID(m)
+		last, ok := batch[series]
+		if !ok {
+			if e, ok := l.entries[series]; ok {
+				last = e.Value.(*lastValue)
+			}
+		}
+		fields := m.Fields()
+		if last != nil && l.unchanged(last, m.Time(), fields) {
+			continue
+		}
+		batch[series] = &lastValue{series: series, fields: fields, time: m.Time()}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// unchanged returns true if a metric with the given time and fields can be
+// dropped given the last value of its series.
+func (l *lastValues) unchanged(last *lastValue, t time.Time, fields map[string]interface{}) bool {
+	if l.maxStaleness > 0 && t.Sub(last.time) >= l.maxStaleness {
+		return false
+	}
+	return reflect.DeepEqual(last.fields, fields)
+}
+
+// update remembers the fields of written metrics.
+func (l *lastValues) update(metrics []telegraf.Metric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range metrics {
+		series := seriesID(m)
+		v := &lastValue{series: series, fields: m.Fields(), time: m.Time()}
+		if e, ok := l.entries[series]; ok {
+			e.Value = v
+			l.lru.MoveToFront(e)
+			continue
+		}
+		l.entries[series] = l.lru.PushFront(v)
+		for l.lru.Len() > l.maxSize {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*lastValue).series)
+		}
+	}
+}
+
+// len returns the number of series held.
+func (l *lastValues) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
@@ -0,0 +1,84 @@
+package cratedb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastValues(t *testing.T) {
+	now := time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC)
+	newMetric := func(host string, idle float64, offset time.Duration) telegraf.Metric {
+		m, err := metric.New("cpu", map[string]string{"host": host}, map[string]interface{}{"idle": idle}, now.Add(offset))
+		require.NoError(t, err)
+		return m
+	}
+
+	l := newLastValues(2, time.Hour)
+	batch := []telegraf.Metric{
+		newMetric("a", 0.5, 0),
+		newMetric("a", 0.5, time.Minute),
+		newMetric("a", 0.25, 2*time.Minute),
+		newMetric("b", 0.5, 0),
+	}
+	kept := l.filter(batch)
+	require.Equal(t, []telegraf.Metric{batch[0], batch[2], batch[3]}, kept)
+	// Nothing is remembered until update is called.
+	require.Equal(t, 0, l.len())
+	require.Len(t, l.filter(batch), 3)
+
+	l.update(kept)
+	require.Equal(t, 2, l.len())
+	require.Empty(t, l.filter([]telegraf.Metric{newMetric("a", 0.25, 5*time.Minute), newMetric("b", 0.5, 5*time.Minute)}))
+
+	// The last write of "b" is an hour old, so it's written anyway.
+	stale := newMetric("b", 0.5, time.Hour)
+	require.Equal(t, []telegraf.Metric{stale}, l.filter([]telegraf.Metric{stale}))
+
+	// "c" evicts "a", the least recently written series.
+	l.update([]telegraf.Metric{newMetric("b", 0.5, 10*time.Minute), newMetric("c", 0.5, 10*time.Minute)})
+	require.Equal(t, 2, l.len())
+	a := newMetric("a", 0.25, 10*time.Minute)
+	require.Equal(t, []telegraf.Metric{a}, l.filter([]telegraf.Metric{a, newMetric("b", 0.5, 10*time.Minute), newMetric("c", 0.5, 10*time.Minute)}))
+}
+
+func TestWriteSuppressUnchanged(t *testing.T) {
+	now := time.Date(2017, 8, 7, 16, 44, 52, 0, time.UTC)
+	m, err := metric.New("cpu", map[string]string{"host": "a"}, map[string]interface{}{"idle": 0.5}, now)
+	require.NoError(t, err)
+
+	var down bool
+	fd := &fakeDriver{
+		exec: func(query string) error {
+			if down {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	}
+	c := &CrateDB{
+		Table:                "my_table",
+		Timeout:              internal.Duration{Duration: time.Second * 5},
+		SuppressUnchanged:    true,
+		SuppressMaxStaleness: internal.Duration{Duration: time.Hour},
+		SuppressCacheSize:    10,
+	}
+	require.NoError(t, c.setup())
+	c.DB = fd.open(t)
+
+	// A failed write must not be remembered, or the retry would be dropped.
+	down = true
+	require.Error(t, c.Write([]telegraf.Metric{m}))
+	down = false
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	require.NoError(t, c.Write([]telegraf.Metric{m}))
+	require.Len(t, fd.statements(), 2)
+
+	c.SuppressCacheSize = 0
+	require.Error(t, c.setup())
+}
@@ -0,0 +1,70 @@
+package cratedb
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// utf8Sanitizer replaces invalid UTF-8 in strings, see SanitizeUTF8.
+type utf8Sanitizer struct {
+	replacement string
+	// sanitized counts the strings that contained invalid UTF-8.
+	sanitized int
+}
+
+// sanitize returns s with each run of invalid UTF-8 bytes replaced with the
+// replacement, like strings.ToValidUTF8 of newer Go versions.
+func (u *utf8Sanitizer) sanitize(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	u.sanitized++
+
+	var buf bytes.Buffer
+	invalid := false
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			if !invalid {
+				buf.WriteString(u.replacement)
+				invalid = true
+			}
+			i++
+			continue
+		}
+		invalid = false
+		buf.WriteString(s[i : i+size])
+		i += size
+	}
+	return buf.String()
+}
+
+// sanitizeInterval is the minimum time between two warnings about sanitized
+// strings.
+const sanitizeInterval = time.Minute
+
+// sanitizeLog logs the number of sanitized strings at most once per
+// sanitizeInterval, so an input producing invalid UTF-8 in every metric
+// doesn't flood the log.
+type sanitizeLog struct {
+	mu      sync.Mutex
+	pending int
+	next    time.Time
+}
+
+// log adds n sanitized strings and logs them if the last warning is at least
+// sanitizeInterval ago.
+func (l *sanitizeLog) log(n int, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending += n
+	if l.pending == 0 || now.Before(l.next) {
+		return
+	}
+	log.Printf("W! CrateDB: replaced invalid UTF-8 in %d strings", l.pending)
+	l.pending = 0
+	l.next = now.Add(sanitizeInterval)
+}
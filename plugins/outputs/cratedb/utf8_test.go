@@ -0,0 +1,84 @@
+package cratedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_utf8Sanitizer(t *testing.T) {
+	for _, test := range []struct {
+		Val  string
+		Want string
+	}{
+		{"Grüße 🚀", "Grüße 🚀"},
+		{"a\xffb", "a?b"},
+		{"\xff\xfe\xfd", "?"},
+		{"a\xffb\xfec", "a?b?c"},
+		// A truncated multi byte sequence.
+		{"price \xe2\x82", "price ?"},
+		{"\xc3\x28", "?("},
+		// An encoded surrogate half.
+		{"\xed\xa0\x80", "?"},
+	} {
+		u := &utf8Sanitizer{replacement: "?"}
+		require.Equal(t, test.Want, u.sanitize(test.Val), "val: %q", test.Val)
+		if test.Val == test.Want {
+			require.Equal(t, 0, u.sanitized)
+		} else {
+			require.Equal(t, 1, u.sanitized)
+		}
+	}
+
+	u := &utf8Sanitizer{}
+	require.Equal(t, "ab", u.sanitize("a\xff\xfeb"))
+}
+
+func Test_insertSQLSanitizeUTF8(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	m, err := metric.New(
+		"app",
+		map[string]string{"host": "a\xffb"},
+		map[string]interface{}{"msg\xfe": "it's \xe2\x82", "ok": "fine"},
+		now,
+	)
+	require.NoError(t, err)
+
+	c := &CrateDB{Table: "my_table"}
+	require.NoError(t, c.setup())
+	got, err := c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, "{\"host\" = 'a\xffb'}")
+
+	c.SanitizeUTF8 = true
+	c.UTF8Replacement = "�"
+	got, err = c.insertSQL([]telegraf.Metric{m}, time.UTC)
+	require.NoError(t, err)
+	require.Contains(t, got, `'app', {"host" = 'a�b'}, {"msg�" = 'it''s �', "ok" = 'fine'});`)
+	// The first sanitized strings of a session are logged right away.
+	require.Equal(t, 0, c.utf8Log.pending)
+	require.False(t, c.utf8Log.next.IsZero())
+}
+
+func Test_sanitizeLog(t *testing.T) {
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	l := &sanitizeLog{}
+	l.log(0, now)
+	require.Equal(t, 0, l.pending)
+	require.True(t, l.next.IsZero())
+
+	l.log(2, now)
+	require.Equal(t, 0, l.pending)
+	require.Equal(t, now.Add(sanitizeInterval), l.next)
+
+	// Further strings are only counted until the interval passed.
+	l.log(3, now.Add(time.Second))
+	l.log(1, now.Add(30*time.Second))
+	require.Equal(t, 4, l.pending)
+	l.log(0, now.Add(sanitizeInterval))
+	require.Equal(t, 0, l.pending)
+	require.Equal(t, now.Add(2*sanitizeInterval), l.next)
+}